@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptStaging is the directory of the staging environment of
+// Let's Encrypt, for testing without its rate limits.
+const LetsEncryptStaging = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// ACME certificate key types.
+const (
+	// KeyTypeECDSA serves ECDSA certificates, RSA ones to the clients
+	// without ECDSA support
+	KeyTypeECDSA = "ecdsa"
+	// KeyTypeRSA serves RSA certificates only
+	KeyTypeRSA = "rsa"
+)
+
+// newACMEManager returns the manager of the ACME certificates, configured by
+// the -acme-* flags. With External Account Binding, the account is
+// registered first, as autocert can't.
+func newACMEManager() (*autocert.Manager, error) {
+	switch acmeKeyType {
+	case KeyTypeECDSA, KeyTypeRSA:
+	default:
+		return nil, fmt.Errorf("invalid -acme-key-type %v", acmeKeyType)
+	}
+
+	client := &acme.Client{DirectoryURL: acmeDirectory}
+	if acmeCACert != "" {
+		httpClient, err := httpClientTrusting(acmeCACert)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	cache := autocert.DirCache(acmeCacheDir(acmeCache, acmeDirectory))
+	manager := &autocert.Manager{
+		Cache:  cache,
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if isHostAllowed(host) {
+				return nil
+			}
+			return fmt.Errorf("host %v is not allowed", host)
+		},
+		Email:       acmeEmail,
+		RenewBefore: acmeRenewBefore,
+		Client:      client,
+	}
+
+	if (acmeEABKeyID == "") != (acmeEABHMAC == "") {
+		return nil, errors.New("-acme-eab-kid and -acme-eab-hmac go together")
+	}
+	// the account is shared with the DNS-01 challenges
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	key, err := acmeAccountKey(ctx, cache)
+	if err != nil {
+		return nil, err
+	}
+	client.Key = key
+
+	if acmeEABKeyID != "" {
+		if err := registerEAB(ctx, client, acmeEmail, acmeEABKeyID, acmeEABHMAC); err != nil {
+			return nil, fmt.Errorf("acme account registration: %v", err)
+		}
+	}
+	return manager, nil
+}
+
+// acmeCertificate returns the ACME certificate of the handshake, of the key
+// type configured.
+func acmeCertificate(manager *autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if acmeKeyType == KeyTypeRSA && !isACMEChallenge(hello) {
+		// autocert picks RSA for the clients without ECDSA signatures
+		rsaOnly := *hello
+		rsaOnly.SignatureSchemes = []tls.SignatureScheme{}
+		for _, scheme := range hello.SignatureSchemes {
+			switch scheme {
+			case tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512, tls.ECDSAWithSHA1:
+			default:
+				rsaOnly.SignatureSchemes = append(rsaOnly.SignatureSchemes, scheme)
+			}
+		}
+		if len(rsaOnly.SignatureSchemes) == 0 {
+			rsaOnly.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+		}
+		hello = &rsaOnly
+	}
+	return manager.GetCertificate(hello)
+}
+
+// acmeCacheDir returns the subdirectory of the cache of an ACME directory,
+// the accounts and certificates of CAs never mixing.
+func acmeCacheDir(cache, directory string) string {
+	sum := sha256.Sum256([]byte(directory))
+	return filepath.Join(cache, hex.EncodeToString(sum[:8]))
+}
+
+// supportsECDSA tells if the client supports ECDSA certificates, as autocert
+// decides for its certificates.
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	// the signature schemes, if sent, limit those of the cipher suites
+	if hello.SignatureSchemes != nil && !hasSignatureScheme(hello.SignatureSchemes, tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512, tls.ECDSAWithSHA1) {
+		return false
+	}
+	if hello.SupportedCurves != nil {
+		p256 := false
+		for _, curve := range hello.SupportedCurves {
+			p256 = p256 || curve == tls.CurveP256
+		}
+		if !p256 {
+			return false
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
+
+func hasSignatureScheme(schemes []tls.SignatureScheme, wanted ...tls.SignatureScheme) bool {
+	for _, scheme := range schemes {
+		for _, w := range wanted {
+			if scheme == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func httpClientTrusting(caFile string) (*http.Client, error) {
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("%v: no PEM certificate", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// the cache key of the account key, shared with autocert
+const acmeAccountKeyName = "acme_account+key"
+
+// acmeAccountKey returns the account key of the cache, generated when
+// missing like autocert does.
+func acmeAccountKey(ctx context.Context, cache autocert.Cache) (crypto.Signer, error) {
+	data, err := cache.Get(ctx, acmeAccountKeyName)
+	if err == autocert.ErrCacheMiss {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := cache.Put(ctx, acmeAccountKeyName, data); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid account key in cache")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// registerEAB registers the account of the client key bound to the external
+// account, RFC 8555 section 7.3.4. An account already registered is fine.
+func registerEAB(ctx context.Context, client *acme.Client, email, keyID, hmacKey string) error {
+	macKey, err := decodeBase64URL(hmacKey)
+	if err != nil {
+		return fmt.Errorf("invalid -acme-eab-hmac: %v", err)
+	}
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	jwk, alg, err := jwkOf(client.Key)
+	if err != nil {
+		return err
+	}
+
+	// the account key signed by the MAC key
+	eabProtected, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": keyID, "url": dir.RegURL})
+	eabSigned := b64(eabProtected) + "." + b64(jwk)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(eabSigned))
+	eab := map[string]string{
+		"protected": b64(eabProtected),
+		"payload":   b64(jwk),
+		"signature": b64(mac.Sum(nil)),
+	}
+
+	account := map[string]interface{}{
+		"termsOfServiceAgreed":   true,
+		"externalAccountBinding": eab,
+	}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	payload, _ := json.Marshal(account)
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	nonce, err := fetchNonce(ctx, httpClient, dir.NonceURL)
+	if err != nil {
+		return err
+	}
+	for retry := 0; ; retry++ {
+		protected, _ := json.Marshal(map[string]interface{}{
+			"alg": alg, "jwk": json.RawMessage(jwk), "nonce": nonce, "url": dir.RegURL,
+		})
+		signature, err := jwsSign(client.Key, b64(protected)+"."+b64(payload))
+		if err != nil {
+			return err
+		}
+		body, _ := json.Marshal(map[string]string{
+			"protected": b64(protected),
+			"payload":   b64(payload),
+			"signature": b64(signature),
+		})
+
+		req, err := http.NewRequest(http.MethodPost, dir.RegURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		res, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		raw, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated:
+			return nil
+		case retry == 0 && strings.Contains(string(raw), "badNonce") && res.Header.Get("Replay-Nonce") != "":
+			nonce = res.Header.Get("Replay-Nonce")
+			continue
+		}
+		return fmt.Errorf("%v: %s", res.Status, strings.TrimSpace(string(raw)))
+	}
+}
+
+func fetchNonce(ctx context.Context, httpClient *http.Client, nonceURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, nonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("no nonce from the ACME server")
+	}
+	return nonce, nil
+}
+
+// jwkOf returns the JSON Web Key of the public key, and the JWS algorithm.
+func jwkOf(key crypto.Signer) ([]byte, string, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, "", errors.New("unsupported account key curve, P-256 only")
+		}
+		jwk, _ := json.Marshal(map[string]string{
+			"crv": "P-256",
+			"kty": "EC",
+			"x":   b64(padded(pub.X, 32)),
+			"y":   b64(padded(pub.Y, 32)),
+		})
+		return jwk, "ES256", nil
+	case *rsa.PublicKey:
+		jwk, _ := json.Marshal(map[string]string{
+			"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+			"kty": "RSA",
+			"n":   b64(pub.N.Bytes()),
+		})
+		return jwk, "RS256", nil
+	}
+	return nil, "", errors.New("unsupported account key type")
+}
+
+// jwsSign signs the input with ES256 or RS256.
+func jwsSign(key crypto.Signer, input string) ([]byte, error) {
+	digest := sha256.Sum256([]byte(input))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+		// ASN.1 to the concatenation of r and s
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+			return nil, err
+		}
+		return append(padded(rs.R, 32), padded(rs.S, 32)...), nil
+	}
+	return sig, nil
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMECacheDir(t *testing.T) {
+	production := acmeCacheDir("certs", "https://acme-v02.api.letsencrypt.org/directory")
+	staging := acmeCacheDir("certs", LetsEncryptStaging)
+	if production == staging || filepath.Dir(production) != "certs" || len(filepath.Base(production)) != 16 {
+		t.Errorf("got %v and %v", production, staging)
+	}
+	if again := acmeCacheDir("certs", LetsEncryptStaging); again != staging {
+		t.Errorf("got %v then %v", staging, again)
+	}
+}
+
+// jws is a request body of ACME.
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func (p *jws) decode(t *testing.T, protected, payload interface{}) {
+	t.Helper()
+	for _, part := range []struct {
+		b64 string
+		v   interface{}
+	}{{p.Protected, protected}, {p.Payload, payload}} {
+		raw, err := base64.RawURLEncoding.DecodeString(part.b64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, part.v); err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+	}
+}
+
+func TestRegisterEAB(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	macKey := []byte("0123456789abcdef0123456789abcdef")
+	nonces := []string{"nonce-1", "nonce-2"}
+	var posts int
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(map[string]string{
+				"newNonce":   srv.URL + "/nonce",
+				"newAccount": srv.URL + "/account",
+				"newOrder":   srv.URL + "/order",
+			})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", nonces[0])
+		case "/account":
+			posts++
+			if r.Header.Get("Content-Type") != "application/jose+json" {
+				t.Errorf("content type %q", r.Header.Get("Content-Type"))
+			}
+			var req jws
+			json.NewDecoder(r.Body).Decode(&req)
+			var protected struct {
+				Alg   string
+				JWK   map[string]string
+				Nonce string
+				URL   string
+			}
+			var account struct {
+				TermsOfServiceAgreed   bool
+				Contact                []string
+				ExternalAccountBinding jws
+			}
+			req.decode(t, &protected, &account)
+
+			// the JWS of the account key
+			if protected.Alg != "ES256" || protected.URL != srv.URL+"/account" || protected.JWK["kty"] != "EC" ||
+				protected.JWK["crv"] != "P-256" || protected.JWK["x"] != b64(padded(key.X, 32)) || protected.JWK["y"] != b64(padded(key.Y, 32)) {
+				t.Errorf("protected header %+v", protected)
+			}
+			if protected.Nonce != nonces[posts-1] {
+				t.Errorf("nonce %q, want %q", protected.Nonce, nonces[posts-1])
+			}
+			sig, _ := base64.RawURLEncoding.DecodeString(req.Signature)
+			digest := sha256.Sum256([]byte(req.Protected + "." + req.Payload))
+			if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				t.Error("invalid account key signature")
+			}
+
+			if !account.TermsOfServiceAgreed || len(account.Contact) != 1 || account.Contact[0] != "mailto:admin@example.com" {
+				t.Errorf("account %+v", account)
+			}
+
+			// the account key bound to the external account by its MAC key
+			eab := account.ExternalAccountBinding
+			var eabProtected map[string]string
+			var eabJWK map[string]string
+			eab.decode(t, &eabProtected, &eabJWK)
+			if len(eabProtected) != 3 || eabProtected["alg"] != "HS256" || eabProtected["kid"] != "kid-1" || eabProtected["url"] != srv.URL+"/account" {
+				t.Errorf("binding protected header %v", eabProtected)
+			}
+			if len(eabJWK) != len(protected.JWK) || eabJWK["x"] != protected.JWK["x"] || eabJWK["y"] != protected.JWK["y"] {
+				t.Errorf("binding payload %v, want %v", eabJWK, protected.JWK)
+			}
+			mac := hmac.New(sha256.New, macKey)
+			mac.Write([]byte(eab.Protected + "." + eab.Payload))
+			if eab.Signature != b64(mac.Sum(nil)) {
+				t.Error("invalid binding MAC")
+			}
+
+			if posts == 1 {
+				// a stale nonce, retried once with the new one
+				w.Header().Set("Replay-Nonce", nonces[1])
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := &acme.Client{Key: key, DirectoryURL: srv.URL + "/dir"}
+	err := registerEAB(context.Background(), client, "admin@example.com", "kid-1", base64.RawURLEncoding.EncodeToString(macKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts != 2 {
+		t.Errorf("%v account requests, want 2", posts)
+	}
+}
+
+func TestRegisterEABRejected(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(map[string]string{"newNonce": srv.URL + "/nonce", "newAccount": srv.URL + "/account"})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", "nonce")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized"}`))
+		}
+	}))
+	defer srv.Close()
+
+	client := &acme.Client{Key: key, DirectoryURL: srv.URL + "/dir"}
+	if err := registerEAB(context.Background(), client, "", "kid-1", "c2VjcmV0"); err == nil {
+		t.Error("registered with a rejected binding")
+	}
+	if err := registerEAB(context.Background(), client, "", "kid-1", "not base64!"); err == nil {
+		t.Error("registered with an invalid MAC key")
+	}
+}
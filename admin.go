@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+// newAdminServer serves the admin API on its own listener:
+//
+//	GET  /cache        list cache entries, filtered by ?prefix= or ?mapping=
+//	POST /cache/purge  purge by ?url=, ?prefix=, ?mapping= or ?key= (surrogate key)
+//	GET  /learn        list the unmapped hosts learned, with -learn
+//	GET  /learn/config suggest mappings for the hosts seen ?min_hits= times
+//	POST /learn/reset  forget the hosts learned
+func newAdminServer(proxy *reverseproxy.ReverseProxy) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.Cache == nil {
+			http.Error(w, "cache is disabled", http.StatusNotFound)
+			return
+		}
+		// keys like the purge, https://t.byteio.cn/a becomes t.byteio.cn/a
+		prefix := reverseproxy.CacheKeyOfURL(r.URL.Query().Get("prefix"))
+		mapping := r.URL.Query().Get("mapping")
+
+		entries := []reverseproxy.CacheEntryInfo{}
+		for _, e := range proxy.Cache.Entries() {
+			if strings.HasPrefix(e.Key, prefix) && (mapping == "" || e.Mapping == mapping) {
+				entries = append(entries, e)
+			}
+		}
+		writeJSON(w, entries)
+	})
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if proxy.Cache == nil {
+			http.Error(w, "cache is disabled", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		var match func(*reverseproxy.CacheEntry) bool
+		switch {
+		case q.Get("url") != "":
+			match = reverseproxy.PurgeByKey(reverseproxy.CacheKeyOfURL(q.Get("url")))
+		case q.Get("prefix") != "":
+			match = reverseproxy.PurgeByPrefix(reverseproxy.CacheKeyOfURL(q.Get("prefix")))
+		case q.Get("mapping") != "":
+			match = reverseproxy.PurgeByMapping(q.Get("mapping"))
+		case q.Get("key") != "":
+			match = reverseproxy.PurgeBySurrogateKey(q.Get("key"))
+		default:
+			http.Error(w, "one of url, prefix, mapping or key is required", http.StatusBadRequest)
+			return
+		}
+
+		n := proxy.Cache.Purge(match)
+		log.Printf("admin: purged %v cache entries by %v\n", n, r.URL.RawQuery)
+		writeJSON(w, map[string]int{"purged": n})
+	})
+
+	mux.HandleFunc("/learn", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.Learner == nil {
+			http.Error(w, "learning mode is disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, proxy.Learner.Hosts())
+	})
+	mux.HandleFunc("/learn/config", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.Learner == nil {
+			http.Error(w, "learning mode is disabled", http.StatusNotFound)
+			return
+		}
+		minHits := int64(1)
+		if v := r.URL.Query().Get("min_hits"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid min_hits", http.StatusBadRequest)
+				return
+			}
+			minHits = n
+		}
+		writeJSON(w, proxy.Learner.Suggest(minHits))
+	})
+	mux.HandleFunc("/learn/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if proxy.Learner == nil {
+			http.Error(w, "learning mode is disabled", http.StatusNotFound)
+			return
+		}
+		proxy.Learner.Reset()
+		log.Println("admin: learned hosts reset")
+		writeJSON(w, map[string]bool{"reset": true})
+	})
+
+	srv := NewHTTPServer()
+	srv.Addr = adminBind
+	srv.Handler = requireToken(adminToken, mux)
+	return srv
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
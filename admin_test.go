@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+func newTestAdmin(t *testing.T, token string, keys ...string) (http.Handler, *reverseproxy.Cache) {
+	t.Helper()
+	proxy := reverseproxy.NewReverseProxy(reverseproxy.NewMapGroup(nil))
+	proxy.Cache = reverseproxy.NewCache(1<<20, "")
+	for _, key := range keys {
+		proxy.Cache.Set(&reverseproxy.CacheEntry{Key: key, StatusCode: 200, Header: http.Header{}, Expires: time.Now().Add(time.Hour)})
+	}
+	adminToken = token
+	defer func() { adminToken = "" }()
+	return newAdminServer(proxy).Handler, proxy.Cache
+}
+
+func TestAdminPrefix(t *testing.T) {
+	keys := []string{"t.byteio.cn/a/1", "t.byteio.cn/a/2", "t.byteio.cn/b", "img.byteio.cn/a"}
+	for _, prefix := range []string{"https://t.byteio.cn/a", "t.byteio.cn/a"} {
+		admin, cache := newTestAdmin(t, "", keys...)
+
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, httptest.NewRequest("GET", "/cache?prefix="+prefix, nil))
+		var listed []reverseproxy.CacheEntryInfo
+		if err := json.Unmarshal(rw.Body.Bytes(), &listed); err != nil {
+			t.Fatal(err)
+		}
+
+		rw = httptest.NewRecorder()
+		admin.ServeHTTP(rw, httptest.NewRequest("POST", "/cache/purge?prefix="+prefix, nil))
+		var purged map[string]int
+		if err := json.Unmarshal(rw.Body.Bytes(), &purged); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 2 || purged["purged"] != 2 || len(cache.Entries()) != 2 {
+			t.Errorf("%v: listed %v, purged %v, left %v", prefix, len(listed), purged["purged"], len(cache.Entries()))
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	admin, _ := newTestAdmin(t, "secret")
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secre", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/cache", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, req)
+		if rw.Code != tt.status {
+			t.Errorf("%q: status %v, want %v", tt.auth, rw.Code, tt.status)
+		}
+	}
+}
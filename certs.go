@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+// certStore serves the certificates given on disk: the cert_file and
+// key_file of the mappings, and those of a directory matched by SNI. A file
+// "name.crt" or "name.pem" has its key in "name.key", or in itself;
+// "fullchain.pem" has its key in "privkey.pem", also in the subdirectories
+// as certbot lays them out. Other files are ignored.
+// The files are reloaded when they change, an invalid file is logged and
+// skipped, keeping the certificate it held before.
+type certStore struct {
+	dir    string
+	group  *reverseproxy.MapGroup
+	mu     sync.RWMutex
+	byFile map[string]*tls.Certificate // by certificate file
+	byName map[string]*tls.Certificate // of the directory, by DNS name
+	stamp  string                      // of the files loaded
+}
+
+// certFile is a certificate file with its key file.
+type certFile struct {
+	cert, key string
+	inDir     bool // of the directory, matched by SNI
+}
+
+func newCertStore(group *reverseproxy.MapGroup, dir string) (*certStore, error) {
+	p := &certStore{dir: dir, group: group}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// certificate returns the certificate of the SNI, nil if none is on disk.
+func (p *certStore) certificate(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if mapping := p.group.GetMapping(name); mapping != nil && mapping.CertFile != "" {
+		if cert := p.byFile[mapping.CertFile]; cert != nil {
+			return cert
+		}
+	}
+	if cert := p.byName[name]; cert != nil {
+		return cert
+	}
+	if k := strings.Index(name, "."); k > 0 {
+		return p.byName["*"+name[k:]]
+	}
+	return nil
+}
+
+// files returns the certificate files with their key files.
+func (p *certStore) files() ([]certFile, error) {
+	var files []certFile
+	seen := map[string]bool{}
+	for _, mapping := range p.group.Mappings() {
+		if mapping.CertFile == "" || seen[mapping.CertFile] {
+			continue
+		}
+		seen[mapping.CertFile] = true
+		key := mapping.KeyFile
+		if key == "" {
+			key = mapping.CertFile
+		}
+		files = append(files, certFile{cert: mapping.CertFile, key: key})
+	}
+	if p.dir == "" {
+		return files, nil
+	}
+
+	entries, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		path := filepath.Join(p.dir, e.Name())
+		if e.IsDir() {
+			if f, ok := certbotFile(path); ok {
+				files = append(files, f)
+			}
+			continue
+		}
+		if f, ok := dirFile(path); ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// dirFile returns the certificate file of a file of the directory, false
+// for the keys and the certbot files other than fullchain.pem.
+func dirFile(path string) (certFile, bool) {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	switch {
+	case name == "fullchain.pem":
+		return certFile{cert: path, key: filepath.Join(filepath.Dir(path), "privkey.pem"), inDir: true}, true
+	case name == "privkey.pem" || name == "chain.pem" || name == "cert.pem":
+		return certFile{}, false
+	case ext != ".crt" && ext != ".pem":
+		return certFile{}, false
+	}
+	key := strings.TrimSuffix(path, ext) + ".key"
+	if _, err := os.Stat(key); err != nil {
+		key = path
+	}
+	return certFile{cert: path, key: key, inDir: true}, true
+}
+
+// certbotFile returns the fullchain.pem of a certbot directory.
+func certbotFile(dir string) (certFile, bool) {
+	cert := filepath.Join(dir, "fullchain.pem")
+	if _, err := os.Stat(cert); err != nil {
+		return certFile{}, false
+	}
+	return certFile{cert: cert, key: filepath.Join(dir, "privkey.pem"), inDir: true}, true
+}
+
+// reload loads the files again when they changed since the last load,
+// and tells if they did. An invalid file keeps its certificate loaded
+// before, or is skipped; only an invalid file of a mapping fails the first
+// load.
+func (p *certStore) reload() (bool, error) {
+	files, err := p.files()
+	if err != nil {
+		return false, err
+	}
+	stamp := fileStamp(files)
+	p.mu.RLock()
+	unchanged := stamp == p.stamp
+	loaded := p.byFile
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	byFile := map[string]*tls.Certificate{}
+	byName := map[string]*tls.Certificate{}
+	for _, f := range files {
+		cert, err := loadCertificate(f.cert, f.key)
+		if err != nil {
+			if cert = loaded[f.cert]; cert != nil {
+				log.Printf("load certificate error: %v, keeping the one loaded before\n", err)
+			} else if !f.inDir && loaded == nil {
+				return false, err
+			} else {
+				log.Printf("load certificate error: %v, skipped\n", err)
+				continue
+			}
+		}
+		if f.inDir {
+			for _, name := range certNames(cert.Leaf) {
+				byName[name] = cert
+			}
+		}
+		byFile[f.cert] = cert
+	}
+
+	p.mu.Lock()
+	p.byFile, p.byName, p.stamp = byFile, byName, stamp
+	p.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the files every interval.
+func (p *certStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := p.reload()
+		if err != nil {
+			log.Printf("reload certificates error: %v\n", err)
+		} else if changed {
+			log.Println("certificates reloaded")
+		}
+	}
+}
+
+func fileStamp(files []certFile) string {
+	var stamps []string
+	for _, f := range files {
+		for _, fp := range []string{f.cert, f.key} {
+			if info, err := os.Stat(fp); err == nil {
+				stamps = append(stamps, fmt.Sprintf("%v %v %v", fp, info.Size(), info.ModTime().UnixNano()))
+			} else {
+				stamps = append(stamps, fp)
+			}
+		}
+	}
+	sort.Strings(stamps)
+	return strings.Join(stamps, "\n")
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", certFile, err)
+	}
+	return &cert, nil
+}
+
+// certNames returns the DNS names of a certificate, its common name when it
+// has none.
+func certNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" && net.ParseIP(leaf.Subject.CommonName) == nil {
+		names = []string{leaf.Subject.CommonName}
+	}
+	rv := make([]string, 0, len(names))
+	for _, name := range names {
+		rv = append(rv, strings.ToLower(name))
+	}
+	return rv
+}
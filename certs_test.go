@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+// testCertPEM returns a self signed certificate of the names and its key.
+func testCertPEM(t *testing.T, names ...string) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeTestFile writes a file with a modification time after the one
+// before, the stamps of the files telling them changed.
+func writeTestFile(t *testing.T, path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCertStore(t *testing.T, dir string) *certStore {
+	group := reverseproxy.NewMapGroup([]reverseproxy.DomainMapping{
+		{From: "proxy.test", To: "https://example.net"},
+	})
+	certs, err := newCertStore(group, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func certNameOf(certs *certStore, serverName string) string {
+	cert := certs.certificate(serverName)
+	if cert == nil {
+		return ""
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreDir(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := testCertPEM(t, "a.test")
+	writeTestFile(t, filepath.Join(dir, "a.crt"), cert)
+	writeTestFile(t, filepath.Join(dir, "a.key"), key)
+	cert, key = testCertPEM(t, "*.b.test")
+	writeTestFile(t, filepath.Join(dir, "b.pem"), append(cert, key...))
+	cert, key = testCertPEM(t, "c.test")
+	writeTestFile(t, filepath.Join(dir, "c.test", "fullchain.pem"), cert)
+	writeTestFile(t, filepath.Join(dir, "c.test", "privkey.pem"), key)
+	writeTestFile(t, filepath.Join(dir, "c.test", "chain.pem"), cert)
+	// a key alone, garbage, certbot files without their pair
+	_, key = testCertPEM(t, "key.test")
+	writeTestFile(t, filepath.Join(dir, "key.pem"), key)
+	writeTestFile(t, filepath.Join(dir, "garbage.crt"), []byte("not a certificate"))
+	writeTestFile(t, filepath.Join(dir, "chain.pem"), cert)
+	writeTestFile(t, filepath.Join(dir, "privkey.pem"), key)
+
+	certs := newTestCertStore(t, dir)
+	tests := []struct {
+		serverName string
+		name       string
+	}{
+		{"a.test", "a.test"},
+		{"A.test.", "a.test"},
+		{"x.b.test", "*.b.test"},
+		{"b.test", ""},
+		{"x.y.b.test", ""},
+		{"c.test", "c.test"},
+		{"key.test", ""},
+		{"other.test", ""},
+	}
+	for _, tt := range tests {
+		if got := certNameOf(certs, tt.serverName); got != tt.name {
+			t.Errorf("certificate(%q) = %q, want %q", tt.serverName, got, tt.name)
+		}
+	}
+}
+
+func TestCertStoreMappingFile(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := testCertPEM(t, "mapped.test")
+	writeTestFile(t, filepath.Join(dir, "mapped.crt"), cert)
+	writeTestFile(t, filepath.Join(dir, "mapped.key"), key)
+	group := reverseproxy.NewMapGroup([]reverseproxy.DomainMapping{
+		{From: "proxy.test", To: "https://example.net",
+			CertFile: filepath.Join(dir, "mapped.crt"), KeyFile: filepath.Join(dir, "mapped.key")},
+	})
+	certs, err := newCertStore(group, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := certNameOf(certs, "proxy.test"); got != "mapped.test" {
+		t.Errorf("certificate = %q, want mapped.test", got)
+	}
+
+	// the files of the mappings are configured, invalid ones fail the start
+	group = reverseproxy.NewMapGroup([]reverseproxy.DomainMapping{
+		{From: "proxy.test", To: "https://example.net", CertFile: filepath.Join(dir, "mapped.key")},
+	})
+	if _, err := newCertStore(group, ""); err == nil {
+		t.Error("key only cert_file loaded")
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := testCertPEM(t, "a.test")
+	writeTestFile(t, filepath.Join(dir, "a.pem"), append(cert, key...))
+	certs := newTestCertStore(t, dir)
+	if changed, err := certs.reload(); changed || err != nil {
+		t.Fatalf("reload unchanged = %v, %v", changed, err)
+	}
+
+	// a renewed certificate replaces the one loaded
+	cert, key = testCertPEM(t, "a.test", "www.a.test")
+	writeTestFile(t, filepath.Join(dir, "a.pem"), append(cert, key...))
+	if changed, err := certs.reload(); !changed || err != nil {
+		t.Fatalf("reload renewed = %v, %v", changed, err)
+	}
+	if got := certNameOf(certs, "www.a.test"); got != "a.test" {
+		t.Errorf("renewed certificate not served: %q", got)
+	}
+
+	// a new file is added, a broken one keeps its certificate
+	cert, key = testCertPEM(t, "new.test")
+	writeTestFile(t, filepath.Join(dir, "new.pem"), append(cert, key...))
+	writeTestFile(t, filepath.Join(dir, "a.pem"), []byte("half written"))
+	if changed, err := certs.reload(); !changed || err != nil {
+		t.Fatalf("reload broken = %v, %v", changed, err)
+	}
+	for _, name := range []string{"new.test", "a.test", "www.a.test"} {
+		if certs.certificate(name) == nil {
+			t.Errorf("no certificate of %v after reload", name)
+		}
+	}
+
+	// a removed file is no longer served
+	if err := os.Remove(filepath.Join(dir, "a.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := certs.reload(); !changed || err != nil {
+		t.Fatalf("reload removed = %v, %v", changed, err)
+	}
+	if certs.certificate("a.test") != nil {
+		t.Error("removed certificate still served")
+	}
+	if certs.certificate("new.test") == nil {
+		t.Error("no certificate of new.test after removal")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+// subcommands, run as `proxyany <command> [flags]`
+var commands = map[string]func(args []string){
+	"purge":   runPurge,
+	"learn":   runLearn,
+	"rewrite": runRewrite,
+}
+
+func runPurge(args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:20444", "admin API base URL")
+	token := fs.String("token", os.Getenv("PROXYANY_ADMIN_TOKEN"), "admin API token, default from $PROXYANY_ADMIN_TOKEN")
+	byURL := fs.String("url", "", "purge the cached response of this URL")
+	byPrefix := fs.String("prefix", "", "purge the cached responses of URLs with this prefix")
+	byMapping := fs.String("mapping", "", "purge the cached responses of this mapping (its from host)")
+	byKey := fs.String("key", "", "purge the cached responses tagged with this surrogate key")
+	fs.Parse(args)
+
+	q := url.Values{}
+	for k, v := range map[string]string{"url": *byURL, "prefix": *byPrefix, "mapping": *byMapping, "key": *byKey} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if len(q) != 1 {
+		fmt.Println("exactly one of -url, -prefix, -mapping or -key is required")
+		os.Exit(2)
+	}
+
+	body, err := adminCall(http.MethodPost, *admin, *token, "/cache/purge?"+q.Encode())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Print(body)
+}
+
+func runLearn(args []string) {
+	fs := flag.NewFlagSet("learn", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:20444", "admin API base URL")
+	token := fs.String("token", os.Getenv("PROXYANY_ADMIN_TOKEN"), "admin API token, default from $PROXYANY_ADMIN_TOKEN")
+	config := fs.Bool("config", false, "print the mappings suggested for the learned hosts, to add to the config")
+	minHits := fs.Int("min-hits", 1, "with -config, only the hosts seen at least this many times")
+	reset := fs.Bool("reset", false, "forget the learned hosts")
+	fs.Parse(args)
+
+	method, path := http.MethodGet, "/learn"
+	switch {
+	case *reset:
+		method, path = http.MethodPost, "/learn/reset"
+	case *config:
+		path = fmt.Sprintf("/learn/config?min_hits=%d", *minHits)
+	}
+
+	body, err := adminCall(method, *admin, *token, path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Print(body)
+}
+
+// headerFlag collects repeated "Key: Value" flags.
+type headerFlag http.Header
+
+func (p headerFlag) String() string {
+	return ""
+}
+
+func (p headerFlag) Set(v string) error {
+	k := strings.Index(v, ":")
+	if k < 0 {
+		return fmt.Errorf("header %q is not Key: Value", v)
+	}
+	http.Header(p).Add(strings.TrimSpace(v[:k]), strings.TrimSpace(v[k+1:]))
+	return nil
+}
+
+// runRewrite prints the response sent to the client for an upstream
+// response read from a file or stdin, through the rewriting of the proxy.
+func runRewrite(args []string) {
+	fs := flag.NewFlagSet("rewrite", flag.ExitOnError)
+	config := fs.String("config", cfgPath, "file path domain mapping config in json format")
+	host := fs.String("host", "", "proxy host of the request, selecting the mapping")
+	path := fs.String("path", "/", "path and query of the request")
+	contentType := fs.String("content-type", "text/html; charset=utf-8", "content type of the upstream response")
+	status := fs.Int("status", http.StatusOK, "status of the upstream response")
+	header := headerFlag{}
+	fs.Var(header, "header", "header \"Key: Value\" of the upstream response, repeatable")
+	secure := fs.Bool("https", false, "the client reaches the proxy over HTTPS")
+	showDiff := fs.Bool("diff", false, "print a unified diff of the upstream and rewritten responses")
+	fs.StringVar(&requestBodyTypes, "request-body-types", requestBodyTypes, "comma separated media types of the request bodies whose proxy hosts are rewritten")
+	fs.Int64Var(&requestBodyLimit, "request-body-limit", requestBodyLimit, "size limit in bytes of the request bodies rewritten, larger bodies are sent as is")
+	fs.StringVar(&unmappedRedirect, "unmapped-redirect", unmappedRedirect, "policy for upstream redirects to hosts not mapped: pass, block or follow, follow passes them as upstream is never reached")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of rewrite: proxyany rewrite -host <host> [flags] [file], the body is read from stdin without file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *host == "" {
+		fmt.Println("-host is required")
+		os.Exit(2)
+	}
+	if err := checkRewriteFlags(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	var body []byte
+	var err error
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		body, err = ioutil.ReadFile(fs.Arg(0))
+	} else {
+		body, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+*host+*path, nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *secure {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	upstream := http.Header(header)
+	upstream.Set("Content-Type", *contentType)
+
+	proxy := reverseproxy.NewReverseProxy(reverseproxy.LoadMapGroupFromJson(*config))
+	setRewriteFlags(proxy)
+	res, err := proxy.Preview(req, *status, upstream.Clone(), body)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	rewritten, _ := ioutil.ReadAll(res.Body)
+
+	out := formatResponse(res.StatusCode, res.Header, rewritten)
+	if *showDiff {
+		fmt.Print(unifiedDiff("upstream", "rewritten", formatResponse(*status, upstream, body), out))
+		return
+	}
+	fmt.Print(out)
+}
+
+func formatResponse(status int, header http.Header, body []byte) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%v %v\n", status, http.StatusText(status))
+	header.Write(&out)
+	out.WriteString("\n")
+	out.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+func adminCall(method, admin, token, path string) (string, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(admin, "/")+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%v: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the largest LCS table of the lines left after the common head and tail,
+// bigger texts are dumped fully replaced
+const maxDiffCells = 4 << 20
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns the unified diff of two texts, "" when they're equal.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	if a == b {
+		return ""
+	}
+	linesA, linesB := splitLines(a), splitLines(b)
+	lines := diffLines(linesA, linesB)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %v\n+++ %v\n", nameA, nameB)
+	if lines == nil {
+		// too big to compare
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(1, len(linesA)), hunkRange(1, len(linesB)))
+		for _, l := range linesA {
+			out.WriteString("-" + l + "\n")
+		}
+		for _, l := range linesB {
+			out.WriteString("+" + l + "\n")
+		}
+		return out.String()
+	}
+	const context = 3
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+		// a hunk from the change with its context, merging the changes closer
+		// than twice the context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		lineA, lineB := 1, 1
+		for _, l := range lines[:start] {
+			if l.op != '+' {
+				lineA++
+			}
+			if l.op != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, l := range lines[start:stop] {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for _, l := range lines[start:stop] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+func hunkRange(line, count int) string {
+	if count == 0 {
+		line--
+	}
+	if count == 1 {
+		return fmt.Sprint(line)
+	}
+	return fmt.Sprintf("%v,%v", line, count)
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the edit script of a into b, by their longest common
+// subsequence, nil when the table would be over maxDiffCells.
+func diffLines(a, b []string) []diffLine {
+	var head, tail []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		head = append(head, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		tail = append([]diffLine{{' ', a[len(a)-1]}}, tail...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return nil
+	}
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	middle := []diffLine{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			middle = append(middle, diffLine{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			middle = append(middle, diffLine{'-', a[i]})
+			i++
+		default:
+			middle = append(middle, diffLine{'+', b[j]})
+			j++
+		}
+	}
+
+	rv := append(head, middle...)
+	return append(rv, tail...)
+}
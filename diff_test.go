@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nB\nc\n", "--- x\n+++ y\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"", "a\n", "--- x\n+++ y\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- x\n+++ y\n@@ -1 +0,0 @@\n-a\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\n5\n6\n7\n8\nnine\n",
+			"--- x\n+++ y\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+nine\n"},
+		// changes 7 lines apart make two hunks
+		{"a\n1\n2\n3\n4\n5\n6\n7\nb\n", "A\n1\n2\n3\n4\n5\n6\n7\nB\n",
+			"--- x\n+++ y\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n"},
+		// and 6 lines apart one
+		{"a\n1\n2\n3\n4\n5\n6\nb\n", "A\n1\n2\n3\n4\n5\n6\nB\n",
+			"--- x\n+++ y\n@@ -1,8 +1,8 @@\n-a\n+A\n 1\n 2\n 3\n 4\n 5\n 6\n-b\n+B\n"},
+	}
+	for _, tt := range tests {
+		if got := unifiedDiff("x", "y", tt.a, tt.b); got != tt.want {
+			t.Errorf("%q %q: got\n%v\nwant\n%v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedDiffTooBig(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&a, "a%v\n", i)
+		fmt.Fprintf(&b, "b%v\n", i)
+	}
+	if diffLines(splitLines(a.String()), splitLines(b.String())) != nil {
+		t.Fatal("compared over maxDiffCells")
+	}
+	got := unifiedDiff("x", "y", "same\n"+a.String(), "same\n"+b.String())
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if lines[2] != "@@ -1,3001 +1,3001 @@" || lines[3] != "-same" || lines[3004] != "+same" || len(lines) != 3+2*3001 {
+		t.Errorf("got %v lines: %q", len(lines), lines[:5])
+	}
+}
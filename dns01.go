@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DNSProvider creates and removes the TXT records of the DNS-01 challenges.
+// fqdn is like "_acme-challenge.example.com.", a name may get several
+// values at once, for example.com and *.example.com.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// how long an issuance may take, DNS propagation included
+const dnsIssueTimeout = 10 * time.Minute
+
+// how long a failed issuance is remembered, doubled at each failure up to
+// the maximum, so that handshakes don't hit the rate limits of the CA
+const (
+	dnsRetryMin = time.Minute
+	dnsRetryMax = 24 * time.Hour
+)
+
+// DNS providers by name, for -dns-provider
+var dnsProviders = map[string]func() (DNSProvider, error){
+	"rfc2136": newRFC2136FromFlags,
+}
+
+// dnsManager gets the certificates of the wildcard mappings, like
+// *.mirror.example.com, with DNS-01 challenges, which autocert can't do.
+// The certificates hold the wildcard and the domain, they are cached with
+// those of autocert, and renewed in background. With ECDSA keys, the
+// clients without ECDSA support get an RSA certificate, like autocert.
+type dnsManager struct {
+	client      *acme.Client
+	provider    DNSProvider
+	cache       autocert.Cache
+	email       string
+	renewBefore time.Duration
+	propagation time.Duration
+
+	mu      sync.Mutex
+	certs   map[dnsCert]*tls.Certificate
+	pending map[dnsCert]*dnsIssue
+	failed  map[dnsCert]*dnsFailure
+}
+
+// dnsCert is a certificate of the domain of a wildcard.
+type dnsCert struct {
+	domain string
+	rsa    bool
+}
+
+func (p dnsCert) String() string {
+	if p.rsa {
+		return "*." + p.domain + " (rsa)"
+	}
+	return "*." + p.domain
+}
+
+// dnsFailure is the last failed issuance, not retried before the backoff.
+type dnsFailure struct {
+	err     error
+	at      time.Time
+	backoff time.Duration
+}
+
+// dnsIssue is an issuance in progress, waited by the other handshakes.
+type dnsIssue struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func newDNSManager(client *acme.Client, cache autocert.Cache, provider DNSProvider) *dnsManager {
+	return &dnsManager{
+		client:      client,
+		provider:    provider,
+		cache:       cache,
+		email:       acmeEmail,
+		renewBefore: acmeRenewBefore,
+		propagation: dnsPropagation,
+		certs:       map[dnsCert]*tls.Certificate{},
+		pending:     map[dnsCert]*dnsIssue{},
+		failed:      map[dnsCert]*dnsFailure{},
+	}
+}
+
+// wildcardDomain returns the domain of the wildcard mapping covering the
+// host, "" if none does: mirror.example.com for a.mirror.example.com.
+func wildcardDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range wildcardDomains() {
+		if strings.HasSuffix(host, "."+domain) && !strings.Contains(strings.TrimSuffix(host, "."+domain), ".") {
+			return domain
+		}
+	}
+	return ""
+}
+
+// wildcardDomains returns the domains of the wildcard mappings.
+func wildcardDomains() []string {
+	var domains []string
+	for _, mapping := range mg.Mappings() {
+		if strings.HasPrefix(mapping.From, "*.") {
+			domain := mapping.From[2:]
+			if h, _, err := net.SplitHostPort(domain); err == nil {
+				domain = h
+			}
+			domains = append(domains, strings.ToLower(domain))
+		}
+	}
+	return domains
+}
+
+// certificate returns the certificate of the wildcard domain, issued when
+// missing, renewed in background when expiring. The host policy is up to
+// the caller.
+func (p *dnsManager) certificate(ctx context.Context, key dnsCert) (*tls.Certificate, error) {
+	cert := p.cached(ctx, key)
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+		return p.issue(ctx, key)
+	}
+	if p.expiring(cert) {
+		go p.issue(context.Background(), key)
+	}
+	return cert, nil
+}
+
+// cached returns the certificate in memory or in the cache, nil if none.
+func (p *dnsManager) cached(ctx context.Context, key dnsCert) *tls.Certificate {
+	p.mu.Lock()
+	cert := p.certs[key]
+	p.mu.Unlock()
+	if cert == nil {
+		if loaded, err := p.load(ctx, key); err == nil {
+			cert = loaded
+			p.mu.Lock()
+			p.certs[key] = cert
+			p.mu.Unlock()
+		}
+	}
+	return cert
+}
+
+// helloCert returns the certificate key of the handshake for the domain,
+// RSA for the clients without ECDSA support.
+func helloCert(hello *tls.ClientHelloInfo, domain string) dnsCert {
+	return dnsCert{domain: domain, rsa: acmeKeyType == KeyTypeRSA || !supportsECDSA(hello)}
+}
+
+func (p *dnsManager) expiring(cert *tls.Certificate) bool {
+	return time.Now().Add(p.renewBefore).After(cert.Leaf.NotAfter)
+}
+
+// issue gets a new certificate of the wildcard domain, once at a time, and
+// not before the backoff of the last failure.
+func (p *dnsManager) issue(ctx context.Context, key dnsCert) (*tls.Certificate, error) {
+	p.mu.Lock()
+	if failure := p.failed[key]; failure != nil && time.Since(failure.at) < failure.backoff {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("certificate of %v failed, retried after %v: %v", key, failure.at.Add(failure.backoff).Format(time.RFC3339), failure.err)
+	}
+	if issue, ok := p.pending[key]; ok {
+		p.mu.Unlock()
+		select {
+		case <-issue.done:
+			return issue.cert, issue.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	issue := &dnsIssue{done: make(chan struct{})}
+	p.pending[key] = issue
+	p.mu.Unlock()
+
+	// not bound to the handshake, the other ones wait for it
+	issueCtx, cancel := context.WithTimeout(context.Background(), dnsIssueTimeout)
+	defer cancel()
+	log.Printf("dns-01: requesting certificate of %v\n", key)
+	issue.cert, issue.err = p.obtain(issueCtx, []string{"*." + key.domain, key.domain}, key.rsa)
+	if issue.err == nil {
+		if err := p.store(issueCtx, key, issue.cert); err != nil {
+			log.Printf("dns-01: cache certificate error: %v\n", err)
+		}
+		log.Printf("dns-01: got certificate of %v, expires %v\n", key, issue.cert.Leaf.NotAfter)
+	} else {
+		log.Printf("dns-01: certificate of %v error: %v\n", key, issue.err)
+	}
+
+	p.mu.Lock()
+	if issue.err == nil {
+		p.certs[key] = issue.cert
+		delete(p.failed, key)
+	} else {
+		backoff := dnsRetryMin
+		if last := p.failed[key]; last != nil {
+			backoff = 2 * last.backoff
+			if backoff > dnsRetryMax {
+				backoff = dnsRetryMax
+			}
+		}
+		p.failed[key] = &dnsFailure{err: issue.err, at: time.Now(), backoff: backoff}
+	}
+	delete(p.pending, key)
+	p.mu.Unlock()
+	close(issue.done)
+	return issue.cert, issue.err
+}
+
+// obtain runs an ACME order of the names with DNS-01 challenges, for an RSA
+// key or an ECDSA one.
+func (p *dnsManager) obtain(ctx context.Context, names []string, rsa bool) (*tls.Certificate, error) {
+	var contact []string
+	if p.email != "" {
+		contact = []string{"mailto:" + p.email}
+	}
+	_, err := p.client.Register(ctx, &acme.Account{Contact: contact}, autocert.AcceptTOS)
+	if ae, ok := err.(*acme.Error); err != nil && err != acme.ErrAccountAlreadyExists && !(ok && ae.StatusCode == 409) {
+		return nil, err
+	}
+
+	order, err := p.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+
+	var challenges []*acme.Challenge
+	var authzURLs []string
+	type record struct{ fqdn, value string }
+	var records []record
+	defer func() {
+		for _, r := range records {
+			if err := p.provider.CleanUp(context.Background(), r.fqdn, r.value); err != nil {
+				log.Printf("dns-01: clean up %v error: %v\n", r.fqdn, err)
+			}
+		}
+	}()
+	for _, u := range order.AuthzURLs {
+		authz, err := p.client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("no dns-01 challenge for %v", authz.Identifier.Value)
+		}
+		value, err := p.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+		if err := p.provider.Present(ctx, fqdn, value); err != nil {
+			return nil, fmt.Errorf("create TXT record %v: %v", fqdn, err)
+		}
+		records = append(records, record{fqdn, value})
+		challenges = append(challenges, chal)
+		authzURLs = append(authzURLs, authz.URI)
+	}
+
+	if len(challenges) > 0 && p.propagation > 0 {
+		select {
+		case <-time.After(p.propagation):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	for i, chal := range challenges {
+		if _, err := p.client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err := p.client.WaitAuthorization(ctx, authzURLs[i]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := newCertificateKey(rsa)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := p.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func newCertificateKey(rsaKey bool) (crypto.Signer, error) {
+	if rsaKey {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// cacheKey returns the key of the certificate in the cache, suffixed by
+// "+rsa" like autocert.
+func (p dnsCert) cacheKey() string {
+	if p.rsa {
+		return "wildcard." + p.domain + "+dns01+rsa"
+	}
+	return "wildcard." + p.domain + "+dns01"
+}
+
+// store caches the key and the chain in PEM, like autocert.
+func (p *dnsManager) store(ctx context.Context, key dnsCert, cert *tls.Certificate) error {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	for _, c := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	return p.cache.Put(ctx, key.cacheKey(), data)
+}
+
+func (p *dnsManager) load(ctx context.Context, key dnsCert) (*tls.Certificate, error) {
+	data, err := p.cache.Get(ctx, key.cacheKey())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// renew gets the certificates of the wildcard mappings at startup, and
+// renews them before expiry. The RSA fallbacks of ECDSA mode are only
+// renewed, they are issued at the first client needing one.
+func (p *dnsManager) renew() {
+	for {
+		for _, domain := range wildcardDomains() {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsIssueTimeout)
+			keys := []dnsCert{{domain: domain, rsa: acmeKeyType == KeyTypeRSA}}
+			if fallback := (dnsCert{domain: domain, rsa: true}); acmeKeyType == KeyTypeECDSA && p.cached(ctx, fallback) != nil {
+				keys = append(keys, fallback)
+			}
+			for _, key := range keys {
+				if _, err := p.certificate(ctx, key); err != nil {
+					log.Printf("dns-01: %v\n", err)
+				}
+			}
+			cancel()
+		}
+		time.Sleep(time.Hour)
+	}
+}
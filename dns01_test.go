@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeProvider keeps the TXT records in memory.
+type fakeProvider struct {
+	mu       sync.Mutex
+	records  map[string]bool // fqdn and value
+	presents int
+	cleanups int
+	fail     bool
+}
+
+func (p *fakeProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.presents++
+	if p.fail && p.presents > 1 {
+		return errors.New("provider down")
+	}
+	p.records[fqdn+" "+value] = true
+	return nil
+}
+
+func (p *fakeProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cleanups++
+	delete(p.records, fqdn+" "+value)
+	return nil
+}
+
+func (p *fakeProvider) has(fqdn, value string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.records[fqdn+" "+value]
+}
+
+// fakeACME is an ACME server of one order of *.example.com and example.com,
+// whose challenges check the records of the provider.
+type fakeACME struct {
+	*httptest.Server
+	client   *acme.Client
+	provider *fakeProvider
+	caKey    *ecdsa.PrivateKey
+	ca       *x509.Certificate
+
+	mu       sync.Mutex
+	orders   int
+	accepted map[int]bool
+	invalid  bool // the authorizations fail
+	chain    []byte
+}
+
+func newFakeACME(t *testing.T, provider *fakeProvider) *fakeACME {
+	p := &fakeACME{provider: provider, accepted: map[int]bool{}}
+	p.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &p.caKey.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ca, _ = x509.ParseCertificate(der)
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p.client = &acme.Client{Key: key, DirectoryURL: p.URL + "/dir"}
+	return p
+}
+
+func (p *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var body struct{ Payload string }
+		json.NewDecoder(r.Body).Decode(&body)
+		payload, _ = base64.RawURLEncoding.DecodeString(body.Payload)
+	}
+
+	var id int
+	switch path := r.URL.Path; {
+	case path == "/dir":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   p.URL + "/nonce",
+			"newAccount": p.URL + "/acct",
+			"newOrder":   p.URL + "/order",
+			"revokeCert": p.URL + "/revoke",
+			"keyChange":  p.URL + "/key",
+		})
+	case path == "/nonce":
+	case path == "/acct":
+		w.Header().Set("Location", p.URL+"/acct/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case path == "/order" && r.Method == http.MethodPost && len(payload) > 0:
+		p.orders++
+		p.accepted = map[int]bool{}
+		p.chain = nil
+		w.Header().Set("Location", p.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		p.writeOrder(w)
+	case path == "/order/1":
+		p.writeOrder(w)
+	case sscanf(path, "/authz/%d", &id):
+		status := "pending"
+		if p.accepted[id] {
+			status = "valid"
+			if p.invalid {
+				status = "invalid"
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": "example.com"},
+			"wildcard":   id == 0,
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": p.URL + "/chal/http", "token": "http", "status": "pending"},
+				{"type": "dns-01", "url": fmt.Sprintf("%v/chal/%v", p.URL, id), "token": fmt.Sprint("token", id), "status": status},
+			},
+		})
+	case sscanf(path, "/chal/%d", &id):
+		value, _ := p.client.DNS01ChallengeRecord(fmt.Sprint("token", id))
+		p.accepted[id] = p.provider.has("_acme-challenge.example.com.", value)
+		json.NewEncoder(w).Encode(map[string]string{
+			"type": "dns-01", "url": p.URL + path, "token": fmt.Sprint("token", id), "status": "processing",
+		})
+	case path == "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || !p.accepted[0] || !p.accepted[1] {
+			http.Error(w, `{"type":"urn:ietf:params:acme:error:badCSR"}`, http.StatusForbidden)
+			return
+		}
+		p.chain = p.issue(csr)
+		p.writeOrder(w)
+	case path == "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(p.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func sscanf(s, format string, v *int) bool {
+	_, err := fmt.Sscanf(s, format, v)
+	return err == nil
+}
+
+func (p *fakeACME) writeOrder(w http.ResponseWriter) {
+	status := "pending"
+	if p.accepted[0] && p.accepted[1] && !p.invalid {
+		status = "ready"
+	}
+	order := map[string]interface{}{
+		"identifiers":    []map[string]string{{"type": "dns", "value": "*.example.com"}, {"type": "dns", "value": "example.com"}},
+		"authorizations": []string{p.URL + "/authz/0", p.URL + "/authz/1"},
+		"finalize":       p.URL + "/finalize",
+	}
+	if p.chain != nil {
+		status = "valid"
+		order["certificate"] = p.URL + "/cert"
+	}
+	order["status"] = status
+	json.NewEncoder(w).Encode(order)
+}
+
+// issue returns the PEM chain of the certificate of the CSR.
+func (p *fakeACME) issue(csr *x509.CertificateRequest) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, csr.PublicKey, p.caKey)
+	if err != nil {
+		return nil
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.ca.Raw})...)
+}
+
+func newTestDNSManager(t *testing.T) (*dnsManager, *fakeACME, *fakeProvider) {
+	provider := &fakeProvider{records: map[string]bool{}}
+	server := newFakeACME(t, provider)
+	manager := newDNSManager(server.client, autocert.DirCache(t.TempDir()), provider)
+	manager.propagation = 0
+	return manager, server, provider
+}
+
+func TestDNSObtain(t *testing.T) {
+	for _, rsaKey := range []bool{false, true} {
+		manager, _, provider := newTestDNSManager(t)
+		cert, err := manager.obtain(context.Background(), []string{"*.example.com", "example.com"}, rsaKey)
+		if err != nil {
+			t.Fatalf("rsa %v: %v", rsaKey, err)
+		}
+		if names := cert.Leaf.DNSNames; len(names) != 2 || names[0] != "*.example.com" || names[1] != "example.com" {
+			t.Errorf("rsa %v: names %v", rsaKey, names)
+		}
+		if _, isRSA := cert.PrivateKey.(*rsa.PrivateKey); isRSA != rsaKey || len(cert.Certificate) != 2 {
+			t.Errorf("rsa %v: got %T key, %v certificates", rsaKey, cert.PrivateKey, len(cert.Certificate))
+		}
+		if provider.presents != 2 || provider.cleanups != 2 || len(provider.records) != 0 {
+			t.Errorf("rsa %v: %v records presented, %v cleaned up, %v left", rsaKey, provider.presents, provider.cleanups, provider.records)
+		}
+	}
+}
+
+func TestDNSObtainCleansUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		invalid  bool
+		fail     bool
+		cleanups int
+	}{
+		{"invalid authorization", true, false, 2},
+		{"provider failure", false, true, 1},
+	}
+	for _, tt := range tests {
+		manager, server, provider := newTestDNSManager(t)
+		server.invalid = tt.invalid
+		provider.fail = tt.fail
+		if _, err := manager.obtain(context.Background(), []string{"*.example.com", "example.com"}, false); err == nil {
+			t.Errorf("%v: obtained", tt.name)
+		}
+		if provider.presents != 2 || provider.cleanups != tt.cleanups || len(provider.records) != 0 {
+			t.Errorf("%v: %v records presented, %v cleaned up, %v left", tt.name, provider.presents, provider.cleanups, provider.records)
+		}
+	}
+}
+
+func TestDNSIssueBackoff(t *testing.T) {
+	manager, server, _ := newTestDNSManager(t)
+	server.invalid = true
+	key := dnsCert{domain: "example.com"}
+
+	if _, err := manager.issue(context.Background(), key); err == nil {
+		t.Fatal("issued")
+	}
+	_, err := manager.issue(context.Background(), key)
+	if err == nil || !strings.Contains(err.Error(), "retried after") || server.orders != 1 {
+		t.Errorf("retried at once: %v, %v orders", err, server.orders)
+	}
+
+	// after the backoff, doubled by the new failure
+	manager.failed[key].at = time.Now().Add(-dnsRetryMin)
+	manager.issue(context.Background(), key)
+	if server.orders != 2 || manager.failed[key].backoff != 2*dnsRetryMin {
+		t.Errorf("%v orders, backoff %v", server.orders, manager.failed[key].backoff)
+	}
+
+	// forgotten by a success
+	server.invalid = false
+	manager.failed[key].at = time.Now().Add(-2 * dnsRetryMin)
+	if _, err := manager.issue(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if manager.failed[key] != nil || manager.certs[key] == nil {
+		t.Errorf("failure %+v, certificate %v", manager.failed[key], manager.certs[key])
+	}
+}
+
+func TestDNSCertificateKeyTypes(t *testing.T) {
+	manager, server, _ := newTestDNSManager(t)
+	ecdsaCert, err := manager.certificate(context.Background(), dnsCert{domain: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert, err := manager.certificate(context.Background(), dnsCert{domain: "example.com", rsa: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ecdsaCert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("got %T key", ecdsaCert.PrivateKey)
+	}
+	if _, ok := rsaCert.PrivateKey.(*rsa.PrivateKey); !ok {
+		t.Errorf("got %T key", rsaCert.PrivateKey)
+	}
+
+	// both cached
+	manager.certs = map[dnsCert]*tls.Certificate{}
+	for _, key := range []dnsCert{{domain: "example.com"}, {domain: "example.com", rsa: true}} {
+		if _, err := manager.certificate(context.Background(), key); err != nil {
+			t.Error(err)
+		}
+	}
+	if server.orders != 2 {
+		t.Errorf("%v orders, want 2", server.orders)
+	}
+}
+
+func TestHelloCert(t *testing.T) {
+	modern := &tls.ClientHelloInfo{
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:  []tls.CurveID{tls.X25519, tls.CurveP256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+	}
+	rsaSuites := &tls.ClientHelloInfo{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+	rsaSchemes := *modern
+	rsaSchemes.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+	noP256 := *modern
+	noP256.SupportedCurves = []tls.CurveID{tls.X25519}
+
+	tests := []struct {
+		keyType string
+		hello   *tls.ClientHelloInfo
+		rsa     bool
+	}{
+		{KeyTypeECDSA, modern, false},
+		{KeyTypeECDSA, rsaSuites, true},
+		{KeyTypeECDSA, &rsaSchemes, true},
+		{KeyTypeECDSA, &noP256, true},
+		{KeyTypeRSA, modern, true},
+	}
+	defer func(keyType string) { acmeKeyType = keyType }(acmeKeyType)
+	for i, tt := range tests {
+		acmeKeyType = tt.keyType
+		if got := helloCert(tt.hello, "example.com"); got.domain != "example.com" || got.rsa != tt.rsa {
+			t.Errorf("%v: got %+v, want rsa %v", i, got, tt.rsa)
+		}
+	}
+}
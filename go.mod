@@ -2,4 +2,9 @@ module github.com/weaming/proxyany
 
 go 1.16
 
-require github.com/weaming/golib v0.0.0-20200929065607-3db29cc6ca24
+require (
+	github.com/weaming/golib v0.0.0-20200929065607-3db29cc6ca24
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	golang.org/x/text v0.3.2
+)
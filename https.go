@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	libhttps "github.com/weaming/golib/http/https"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func NewHTTPServer() *http.Server {
@@ -16,12 +23,78 @@ func NewHTTPServer() *http.Server {
 	}
 }
 
-func NewConfig(srv *http.Server) *libhttps.Config {
-	config := &libhttps.Config{
-		CacheDir:         ".",
-		HTTPSecureServer: srv,
-		HTTPServer:       libhttps.NewRedirectServer(),
-		IsHostAllowed:    nil,
+// listenAndServeTLS serves srv on :443 with the certificates on disk, and
+// those of Let's Encrypt for the other hosts allowed, wildcards by DNS-01
+// challenges, while :80 redirects to HTTPS.
+func listenAndServeTLS(srv *http.Server, certs *certStore) error {
+	var manager *autocert.Manager
+	if useACME {
+		var err error
+		manager, err = newACMEManager()
+		if err != nil {
+			return err
+		}
 	}
-	return config
+	var dns *dnsManager
+	if dnsProvider != "" {
+		newProvider, ok := dnsProviders[dnsProvider]
+		if !ok {
+			return fmt.Errorf("unknown -dns-provider %v", dnsProvider)
+		}
+		if manager == nil {
+			return errors.New("-dns-provider requires -acme")
+		}
+		provider, err := newProvider()
+		if err != nil {
+			return err
+		}
+		dns = newDNSManager(manager.Client, manager.Cache, provider)
+		go dns.renew()
+	}
+
+	srv.TLSConfig = &tls.Config{
+		NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if manager != nil && isACMEChallenge(hello) {
+				return manager.GetCertificate(hello)
+			}
+			if cert := certs.certificate(hello.ServerName); cert != nil {
+				return cert, nil
+			}
+			if dns != nil {
+				if domain := wildcardDomain(hello.ServerName); domain != "" && isWildcardHost(hello.ServerName) {
+					// like autocert, the handshake waits for the issuance
+					ctx, cancel := context.WithTimeout(context.Background(), dnsIssueTimeout)
+					defer cancel()
+					return dns.certificate(ctx, helloCert(hello, domain))
+				}
+			}
+			if manager != nil {
+				return acmeCertificate(manager, hello)
+			}
+			return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+		},
+	}
+
+	// https
+	go func() {
+		srv.Addr = ":https"
+		err := srv.ListenAndServeTLS("", "")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+
+	// http
+	redirect := libhttps.NewRedirectServer()
+	if manager != nil {
+		redirect.Handler = manager.HTTPHandler(redirect.Handler)
+	}
+	return redirect.ListenAndServe()
+}
+
+// isACMEChallenge tells if the handshake is a tls-alpn-01 challenge.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
 }
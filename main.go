@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/weaming/proxyany/reverseproxy"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -15,26 +18,139 @@ var (
 	cfgPath = "config.json"
 	version = "version 1.2"
 	mg      *reverseproxy.MapGroup
+
+	recordDir     = ""
+	replayDir     = ""
+	recordHeaders = strings.Join(reverseproxy.DefaultRecordHeaders, ",")
+
+	cacheSize = int64(0)
+	cacheDir  = ""
+
+	upstreamTimeout = time.Duration(0)
+	coalesceTimeout = 10 * time.Second
+
+	adminBind          = ""
+	adminToken         = os.Getenv("PROXYANY_ADMIN_TOKEN")
+	surrogateKeyHeader = reverseproxy.DefaultSurrogateKeyHeader
+
+	requestBodyTypes = strings.Join(reverseproxy.DefaultRequestBodyTypes, ",")
+	requestBodyLimit = int64(reverseproxy.DefaultMaxRequestBody)
+
+	unmappedRedirect = reverseproxy.RedirectPass
+	maxRedirects     = reverseproxy.DefaultMaxRedirects
+
+	learn = false
+
+	certDir    = ""
+	certReload = time.Minute
+	useACME    = true
+
+	acmeDirectory   = autocert.DefaultACMEDirectory
+	acmeEmail       = ""
+	acmeEABKeyID    = ""
+	acmeEABHMAC     = os.Getenv("PROXYANY_ACME_EAB_HMAC")
+	acmeKeyType     = KeyTypeECDSA
+	acmeRenewBefore = 30 * 24 * time.Hour
+	acmeCACert      = ""
+	acmeCache       = "."
+
+	dnsProvider    = ""
+	dnsPropagation = 30 * time.Second
+
+	rfc2136Server        = ""
+	rfc2136Zone          = ""
+	rfc2136TTL           = 60
+	rfc2136TSIGKey       = ""
+	rfc2136TSIGSecret    = os.Getenv("PROXYANY_RFC2136_TSIG_SECRET")
+	rfc2136TSIGAlgorithm = "hmac-sha256"
 )
 
 func init() {
-	fmt.Println(version)
 	flag.StringVar(&cfgPath, "config", cfgPath, "file path domain mapping config in json format")
 	flag.StringVar(&bind, "bind", bind, "local bind [<host>]:<port>")
 	flag.BoolVar(&https, "https", https, "HTTPS mode, auto certification from let's encrypt")
-	flag.Parse()
-
-	mg = reverseproxy.LoadMapGroupFromJson(cfgPath)
+	flag.StringVar(&recordDir, "record", recordDir, "record upstream responses into this directory")
+	flag.StringVar(&replayDir, "replay", replayDir, "serve recorded responses from this directory instead of the upstream")
+	flag.StringVar(&recordHeaders, "record-headers", recordHeaders, "comma separated request headers used as part of the record key")
+	flag.Int64Var(&cacheSize, "cache-size", cacheSize, "memory cache size of rewritten responses in MB, 0 disables the memory tier")
+	flag.StringVar(&cacheDir, "cache-dir", cacheDir, "directory of the disk cache tier of rewritten responses")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", upstreamTimeout, "timeout waiting for upstream response headers, 0 means no timeout")
+	flag.DurationVar(&coalesceTimeout, "coalesce-timeout", coalesceTimeout, "how long identical concurrent cacheable requests wait for one shared upstream fetch, 0 disables coalescing")
+	flag.StringVar(&adminBind, "admin", adminBind, "admin API bind [<host>]:<port>, disabled if empty")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "bearer token required by the admin API, default from $PROXYANY_ADMIN_TOKEN")
+	flag.StringVar(&surrogateKeyHeader, "surrogate-key-header", surrogateKeyHeader, "upstream response header holding the surrogate keys for cache purging")
+	flag.StringVar(&requestBodyTypes, "request-body-types", requestBodyTypes, "comma separated media types of the request bodies whose proxy hosts are rewritten")
+	flag.Int64Var(&requestBodyLimit, "request-body-limit", requestBodyLimit, "size limit in bytes of the request bodies rewritten, larger bodies are sent as is")
+	flag.StringVar(&unmappedRedirect, "unmapped-redirect", unmappedRedirect, "policy for upstream redirects to hosts not mapped: pass, block or follow")
+	flag.IntVar(&maxRedirects, "max-redirects", maxRedirects, "redirects followed by the follow policy of -unmapped-redirect")
+	flag.StringVar(&certDir, "cert-dir", certDir, "HTTPS mode, directory of PEM certificates matched by SNI, name.crt or name.pem with its key in name.key or in itself, fullchain.pem with privkey.pem as certbot lays them out")
+	flag.DurationVar(&certReload, "cert-reload", certReload, "HTTPS mode, how often the certificate files are checked for changes, 0 disables reloading")
+	flag.BoolVar(&useACME, "acme", useACME, "HTTPS mode, get certificates from let's encrypt for the hosts without certificate files")
+	flag.StringVar(&acmeDirectory, "acme-directory", acmeDirectory, "ACME directory URL, like "+LetsEncryptStaging+" or a private CA")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "contact email of the ACME account")
+	flag.StringVar(&acmeEABKeyID, "acme-eab-kid", acmeEABKeyID, "key identifier of the External Account Binding required by some CAs")
+	flag.StringVar(&acmeEABHMAC, "acme-eab-hmac", acmeEABHMAC, "base64url HMAC key of the External Account Binding, default from $PROXYANY_ACME_EAB_HMAC")
+	flag.StringVar(&acmeKeyType, "acme-key-type", acmeKeyType, "key type of the ACME certificates: ecdsa, with RSA for clients without ECDSA, or rsa")
+	flag.DurationVar(&acmeRenewBefore, "acme-renew-before", acmeRenewBefore, "how long before expiry the ACME certificates are renewed")
+	flag.StringVar(&acmeCACert, "acme-ca-cert", acmeCACert, "PEM root certificate trusted for the ACME directory, for a private CA like Pebble")
+	flag.StringVar(&acmeCache, "acme-cache", acmeCache, "directory of the ACME account keys and certificates, in a subdirectory per ACME directory")
+	flag.StringVar(&dnsProvider, "dns-provider", dnsProvider, "DNS provider of the ACME DNS-01 challenges of the wildcard mappings, rfc2136, disabled if empty")
+	flag.DurationVar(&dnsPropagation, "dns-propagation", dnsPropagation, "how long the DNS-01 records are given to propagate before validation")
+	flag.StringVar(&rfc2136Server, "rfc2136-server", rfc2136Server, "rfc2136 provider, DNS server accepting the updates, <host>[:<port>]")
+	flag.StringVar(&rfc2136Zone, "rfc2136-zone", rfc2136Zone, "rfc2136 provider, zone holding the _acme-challenge records")
+	flag.IntVar(&rfc2136TTL, "rfc2136-ttl", rfc2136TTL, "rfc2136 provider, TTL of the TXT records")
+	flag.StringVar(&rfc2136TSIGKey, "rfc2136-tsig-key", rfc2136TSIGKey, "rfc2136 provider, TSIG key name, unsigned updates if empty")
+	flag.StringVar(&rfc2136TSIGSecret, "rfc2136-tsig-secret", rfc2136TSIGSecret, "rfc2136 provider, base64 TSIG secret, default from $PROXYANY_RFC2136_TSIG_SECRET")
+	flag.StringVar(&rfc2136TSIGAlgorithm, "rfc2136-tsig-algorithm", rfc2136TSIGAlgorithm, "rfc2136 provider, TSIG algorithm: hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512")
+	flag.BoolVar(&learn, "learn", learn, "learning mode, collect the unmapped hosts of upstream responses, see the admin API")
 }
 
 func main() {
-	srv := newProxyServer()
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	fmt.Println(version)
+	flag.Parse()
+	mg = reverseproxy.LoadMapGroupFromJson(cfgPath)
+	if err := checkRewriteFlags(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	proxy := newReverseProxy()
+	if adminBind != "" {
+		go func() {
+			fmt.Printf("admin listening %v\n", adminBind)
+			err := newAdminServer(proxy).ListenAndServe()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	srv := NewHTTPServer()
+	srv.Handler = proxy
 	if https {
-		config := NewConfig(srv)
-		config.IsHostAllowed = isHostAllowed
+		certs, err := newCertStore(mg, certDir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if certReload > 0 {
+			go certs.watch(certReload)
+		}
 
 		fmt.Printf("listening :443\n")
-		config.ListenAndServeTLS()
+		err = listenAndServeTLS(srv, certs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else {
 		srv.Addr = bind
 
@@ -49,20 +165,70 @@ func main() {
 
 }
 
-func newProxyServer() *http.Server {
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy := reverseproxy.NewReverseProxy(mg)
-		proxy.ServeHTTP(w, r)
-	})
+func newReverseProxy() *reverseproxy.ReverseProxy {
+	proxy := reverseproxy.NewReverseProxy(mg)
+	if t, ok := proxy.Transport.(*http.Transport); ok {
+		t.ResponseHeaderTimeout = upstreamTimeout
+	}
+	setRewriteFlags(proxy)
+	proxy.MaxRedirects = maxRedirects
+	if learn {
+		proxy.Learner = reverseproxy.NewLearner()
+	}
+	if replayDir != "" {
+		proxy.Transport = newRecordTransport(replayDir, true, proxy.Transport)
+	} else if recordDir != "" {
+		proxy.Transport = newRecordTransport(recordDir, false, proxy.Transport)
+	}
+	if cacheSize > 0 || cacheDir != "" {
+		proxy.Cache = reverseproxy.NewCache(cacheSize<<20, cacheDir)
+		proxy.Cache.SurrogateKeyHeader = surrogateKeyHeader
+		proxy.CoalesceTimeout = coalesceTimeout
+	}
+	return proxy
+}
+
+// checkRewriteFlags checks the flags of setRewriteFlags.
+func checkRewriteFlags() error {
+	switch unmappedRedirect {
+	case reverseproxy.RedirectPass, reverseproxy.RedirectBlock, reverseproxy.RedirectFollow:
+		return nil
+	}
+	return fmt.Errorf("invalid -unmapped-redirect %v", unmappedRedirect)
+}
+
+// setRewriteFlags sets the flags changing the rewriting, shared by the server
+// and the rewrite command.
+func setRewriteFlags(proxy *reverseproxy.ReverseProxy) {
+	proxy.RequestBodyTypes = nil
+	for _, t := range strings.Split(requestBodyTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			proxy.RequestBodyTypes = append(proxy.RequestBodyTypes, t)
+		}
+	}
+	proxy.MaxRequestBody = requestBodyLimit
+	proxy.UnmappedRedirect = unmappedRedirect
+}
 
-	srv := NewHTTPServer()
-	srv.Handler = handler
-	return srv
+func newRecordTransport(dir string, replay bool, transport http.RoundTripper) *reverseproxy.RecordTransport {
+	rt := reverseproxy.NewRecordTransport(dir, replay, transport)
+	for _, h := range strings.Split(recordHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			rt.Headers = append(rt.Headers, h)
+		}
+	}
+	return rt
 }
 
+// isHostAllowed tells if the host gets its own certificate. The hosts of
+// wildcard mappings don't, they share the certificate of DNS-01.
 func isHostAllowed(host string) bool {
-	if mg.GetMapping(host) != nil {
-		return true
-	}
-	return false
+	mapping := mg.GetMapping(host)
+	return mapping != nil && !mapping.Wildcard()
+}
+
+// isWildcardHost tells if the host is proxied by a wildcard mapping.
+func isWildcardHost(host string) bool {
+	mapping := mg.GetMapping(host)
+	return mapping != nil && mapping.Wildcard()
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/weaming/proxyany/reverseproxy"
+)
+
+func TestIsHostAllowed(t *testing.T) {
+	mg = reverseproxy.NewMapGroup([]reverseproxy.DomainMapping{
+		{From: "static.proxy.test", To: "https://example.net"},
+		{From: "*.proxy.test", To: "https://*", Allow: []string{"*"}},
+	})
+	defer func() { mg = nil }()
+	tests := []struct {
+		host     string
+		allowed  bool
+		wildcard bool
+	}{
+		{"static.proxy.test", true, false},
+		{"www-example-com.proxy.test", false, true},
+		{"127-0-0-1.proxy.test", false, false},
+		{"other.test", false, false},
+	}
+	for _, tt := range tests {
+		if got := isHostAllowed(tt.host); got != tt.allowed {
+			t.Errorf("isHostAllowed(%q) = %v, want %v", tt.host, got, tt.allowed)
+		}
+		if got := isWildcardHost(tt.host); got != tt.wildcard {
+			t.Errorf("isWildcardHost(%q) = %v, want %v", tt.host, got, tt.wildcard)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a rewritten response stored in the Cache.
+// Entries are never modified after being stored.
+type CacheEntry struct {
+	Key        string      `json:"key"`
+	Mapping    string      `json:"mapping"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+
+	// Vary holds the request header values selected by the Vary response header
+	Vary http.Header `json:"vary,omitempty"`
+
+	// Stored is the time the response was generated by upstream
+	Stored time.Time `json:"stored"`
+	// Expires is the end of the freshness lifetime
+	Expires time.Time `json:"expires"`
+
+	// upstream validators, used for revalidation
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// SurrogateKeys are taken from the upstream response, for purging
+	SurrogateKeys []string `json:"surrogate_keys,omitempty"`
+
+	// Integrity holds the keys of the entries whose hash is in the body,
+	// with the Stored time of the version hashed
+	Integrity map[string]time.Time `json:"integrity,omitempty"`
+
+	// Hits counts the responses served from the entries of the key when
+	// it was written to disk, the Cache counts them after
+	Hits int64 `json:"hits"`
+}
+
+// CacheEntryInfo describes a cache entry for the admin API.
+type CacheEntryInfo struct {
+	Key           string    `json:"key"`
+	Mapping       string    `json:"mapping"`
+	StatusCode    int       `json:"status_code"`
+	Size          int64     `json:"size"`
+	Age           int64     `json:"age"`
+	TTL           int64     `json:"ttl"`
+	Expires       time.Time `json:"expires"`
+	Hits          int64     `json:"hits"`
+	SurrogateKeys []string  `json:"surrogate_keys,omitempty"`
+	InMemory      bool      `json:"in_memory"`
+}
+
+func (p *CacheEntry) info(now time.Time, hits int64, inMemory bool) CacheEntryInfo {
+	return CacheEntryInfo{
+		Key:           p.Key,
+		Mapping:       p.Mapping,
+		StatusCode:    p.StatusCode,
+		Size:          p.size(),
+		Age:           int64(p.age(now) / time.Second),
+		TTL:           int64(p.Expires.Sub(now) / time.Second),
+		Expires:       p.Expires,
+		Hits:          hits,
+		SurrogateKeys: p.SurrogateKeys,
+		InMemory:      inMemory,
+	}
+}
+
+func (p *CacheEntry) hasSurrogateKey(key string) bool {
+	for _, k := range p.SurrogateKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheKeyOfURL returns the cache key of an absolute URL like
+// https://t.byteio.cn/home, a value which is not a URL is taken as the key.
+func CacheKeyOfURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	return strings.ToLower(u.Host) + u.RequestURI()
+}
+
+// Purge filters used by the admin API.
+
+func PurgeByKey(key string) func(*CacheEntry) bool {
+	return func(e *CacheEntry) bool { return e.Key == key }
+}
+
+func PurgeByPrefix(prefix string) func(*CacheEntry) bool {
+	return func(e *CacheEntry) bool { return strings.HasPrefix(e.Key, prefix) }
+}
+
+func PurgeByMapping(from string) func(*CacheEntry) bool {
+	return func(e *CacheEntry) bool { return e.Mapping == from }
+}
+
+func PurgeBySurrogateKey(key string) func(*CacheEntry) bool {
+	return func(e *CacheEntry) bool { return e.hasSurrogateKey(key) }
+}
+
+// integrityValid tells if the entries hashed in the body of the entry are
+// still those in the cache, and fresh.
+func (p *Cache) integrityValid(entry *CacheEntry, now time.Time) bool {
+	for key, stored := range entry.Integrity {
+		hashed := p.Get(key)
+		if hashed == nil || !hashed.fresh(now) || !hashed.Stored.Equal(stored) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *CacheEntry) fresh(now time.Time) bool {
+	return now.Before(p.Expires)
+}
+
+func (p *CacheEntry) age(now time.Time) time.Duration {
+	if age := now.Sub(p.Stored); age > 0 {
+		return age
+	}
+	return 0
+}
+
+func (p *CacheEntry) size() int64 {
+	n := int64(len(p.Key) + len(p.Body))
+	for k, vv := range p.Header {
+		for _, v := range vv {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+func (p *CacheEntry) matchVary(req *http.Request) bool {
+	for k, vv := range p.Vary {
+		if req.Header.Get(k) != vv[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Cache is a memory LRU cache of rewritten responses limited to MaxSize
+// bytes, with an optional disk tier in Dir which also survives restarts.
+type Cache struct {
+	MaxSize int64
+	Dir     string
+
+	// SurrogateKeyHeader is the upstream response header holding
+	// the space separated surrogate keys of the response
+	SurrogateKeyHeader string
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+	// hits of the entries of both tiers by key, saved with an entry when
+	// it is written to disk
+	hits map[string]int64
+}
+
+const DefaultSurrogateKeyHeader = "Surrogate-Key"
+
+func NewCache(maxSize int64, dir string) *Cache {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("create cache dir error: %v\n", err)
+		}
+	}
+	return &Cache{
+		MaxSize:            maxSize,
+		Dir:                dir,
+		SurrogateKeyHeader: DefaultSurrogateKeyHeader,
+		lru:                list.New(),
+		items:              map[string]*list.Element{},
+		hits:               map[string]int64{},
+	}
+}
+
+func (p *Cache) Get(key string) *CacheEntry {
+	p.mu.Lock()
+	if el, ok := p.items[key]; ok {
+		p.lru.MoveToFront(el)
+		p.mu.Unlock()
+		return el.Value.(*CacheEntry)
+	}
+	p.mu.Unlock()
+
+	if p.Dir == "" {
+		return nil
+	}
+	entry, err := p.readDisk(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("read cache error: %v\n", err)
+		}
+		return nil
+	}
+	p.mu.Lock()
+	if _, ok := p.hits[key]; !ok {
+		p.hits[key] = entry.Hits
+	}
+	p.mu.Unlock()
+	p.setMemory(entry)
+	return entry
+}
+
+// Set stores the entry, its hits go on from those of the key.
+func (p *Cache) Set(entry *CacheEntry) {
+	p.mu.Lock()
+	if _, ok := p.hits[entry.Key]; !ok {
+		p.hits[entry.Key] = entry.Hits
+	}
+	p.mu.Unlock()
+	p.setMemory(entry)
+	if p.Dir != "" {
+		if err := p.writeDisk(entry); err != nil {
+			log.Printf("write cache error: %v\n", err)
+		}
+	}
+}
+
+// hit counts a response served from the entry of the key.
+func (p *Cache) hit(key string) {
+	p.mu.Lock()
+	p.hits[key]++
+	p.mu.Unlock()
+}
+
+// hitCount returns the hits of the entry of the key.
+func (p *Cache) hitCount(key string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hits[key]
+}
+
+func (p *Cache) Delete(key string) {
+	p.mu.Lock()
+	if el, ok := p.items[key]; ok {
+		p.removeElement(el)
+	}
+	delete(p.hits, key)
+	p.mu.Unlock()
+
+	if p.Dir != "" {
+		if err := os.Remove(p.diskPath(key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("delete cache error: %v\n", err)
+		}
+	}
+}
+
+// Entries returns the entries of both tiers, sorted by key.
+func (p *Cache) Entries() []CacheEntryInfo {
+	now := time.Now()
+	seen := map[string]bool{}
+	infos := []CacheEntryInfo{}
+
+	hits := map[string]int64{}
+	p.mu.Lock()
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*CacheEntry)
+		seen[entry.Key] = true
+		infos = append(infos, entry.info(now, p.hits[entry.Key], true))
+	}
+	for k, v := range p.hits {
+		if !seen[k] {
+			hits[k] = v
+		}
+	}
+	p.mu.Unlock()
+
+	p.rangeDisk(func(entry *CacheEntry, fp string) {
+		if !seen[entry.Key] {
+			n, ok := hits[entry.Key]
+			if !ok {
+				n = entry.Hits
+			}
+			infos = append(infos, entry.info(now, n, false))
+		}
+	})
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// Purge deletes the entries of both tiers matching the filter,
+// and returns the number of entries deleted.
+func (p *Cache) Purge(match func(*CacheEntry) bool) int {
+	purged := map[string]bool{}
+
+	p.mu.Lock()
+	for el := p.lru.Front(); el != nil; {
+		next := el.Next()
+		if entry := el.Value.(*CacheEntry); match(entry) {
+			purged[entry.Key] = true
+			p.removeElement(el)
+			delete(p.hits, entry.Key)
+		}
+		el = next
+	}
+	p.mu.Unlock()
+
+	p.rangeDisk(func(entry *CacheEntry, fp string) {
+		if match(entry) {
+			purged[entry.Key] = true
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				log.Printf("delete cache error: %v\n", err)
+			}
+		}
+	})
+	p.mu.Lock()
+	for key := range purged {
+		delete(p.hits, key)
+	}
+	p.mu.Unlock()
+	return len(purged)
+}
+
+func (p *Cache) rangeDisk(fn func(entry *CacheEntry, fp string)) {
+	if p.Dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(p.Dir, "*.json"))
+	if err != nil {
+		log.Printf("list cache error: %v\n", err)
+		return
+	}
+	for _, fp := range files {
+		raw, err := ioutil.ReadFile(fp)
+		if err != nil {
+			continue
+		}
+		entry := &CacheEntry{}
+		if err := json.Unmarshal(raw, entry); err != nil {
+			continue
+		}
+		fn(entry, fp)
+	}
+}
+
+func (p *Cache) setMemory(entry *CacheEntry) {
+	size := entry.size()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.items[entry.Key]; ok {
+		p.removeElement(el)
+	}
+	if size > p.MaxSize {
+		p.forgetHits(entry.Key)
+		return
+	}
+	p.items[entry.Key] = p.lru.PushFront(entry)
+	p.size += size
+	for p.size > p.MaxSize {
+		evicted := p.lru.Back().Value.(*CacheEntry)
+		p.removeElement(p.lru.Back())
+		p.forgetHits(evicted.Key)
+	}
+}
+
+// forgetHits drops the hits of an entry no longer in the memory tier,
+// unless it is on disk. It must be called with p.mu held.
+func (p *Cache) forgetHits(key string) {
+	if p.Dir == "" {
+		delete(p.hits, key)
+	}
+}
+
+// removeElement must be called with p.mu held.
+func (p *Cache) removeElement(el *list.Element) {
+	entry := p.lru.Remove(el).(*CacheEntry)
+	delete(p.items, entry.Key)
+	p.size -= entry.size()
+}
+
+func (p *Cache) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(p.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (p *Cache) readDisk(key string) (*CacheEntry, error) {
+	raw, err := ioutil.ReadFile(p.diskPath(key))
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// writeDisk saves the entry with the hits counted.
+func (p *Cache) writeDisk(entry *CacheEntry) error {
+	saved := *entry
+	saved.Hits = p.hitCount(entry.Key)
+	raw, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	fp := p.diskPath(entry.Key)
+	tmp, err := ioutil.TempFile(p.Dir, ".entry-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
@@ -0,0 +1,107 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCacheHits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+	tests := []struct {
+		name    string
+		maxSize int64
+		disk    bool
+	}{
+		{"memory", 1 << 20, false},
+		{"disk only", 0, true},
+		{"both tiers", 1 << 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := ""
+			if tt.disk {
+				dir = t.TempDir()
+			}
+			proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+			proxy.Cache = NewCache(tt.maxSize, dir)
+			for i := 0; i < 4; i++ {
+				testGet(proxy, "/", nil)
+			}
+			entries := proxy.Cache.Entries()
+			if len(entries) != 1 || entries[0].Hits != 3 {
+				t.Fatalf("entries %+v, want 3 hits", entries)
+			}
+
+			proxy.Cache.Delete(entries[0].Key)
+			testGet(proxy, "/", nil)
+			if entries := proxy.Cache.Entries(); len(entries) != 1 || entries[0].Hits != 0 {
+				t.Errorf("entries after delete %+v, want 0 hits", entries)
+			}
+		})
+	}
+}
+
+func TestCacheHitsSaved(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"a"`)
+		if r.Header.Get("If-None-Match") == `"a"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+	proxy.Cache = NewCache(0, dir)
+
+	// every request after the first one revalidates, which stores the
+	// entry again with its hits
+	for i := 0; i < 3; i++ {
+		testGet(proxy, "/", nil)
+	}
+	restarted := NewCache(0, dir)
+	if entries := restarted.Entries(); len(entries) != 1 || entries[0].Hits != 1 {
+		t.Errorf("entries after restart %+v, want the hit saved by the last revalidation", entries)
+	}
+	if entries := proxy.Cache.Entries(); len(entries) != 1 || entries[0].Hits != 2 {
+		t.Errorf("entries %+v, want 2 hits", entries)
+	}
+}
+
+func TestCacheHitsConcurrentRevalidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"a"`)
+		if r.Header.Get("If-None-Match") == `"a"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+	proxy.Cache = NewCache(1<<20, t.TempDir())
+	testGet(proxy, "/", nil)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testGet(proxy, "/", nil)
+		}()
+	}
+	wg.Wait()
+	if entries := proxy.Cache.Entries(); len(entries) != 1 || entries[0].Hits != n {
+		t.Errorf("entries %+v, want %v hits", entries, n)
+	}
+}
@@ -0,0 +1,340 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+)
+
+// Bodies are rewritten as UTF-8, or as any encoding compatible with ASCII
+// where a byte below 0x80 is always an ASCII character, like latin1 or
+// windows-1252. Other encodings are handled before rewriting:
+//
+//   - UTF-16 is decoded, and sent to the client as UTF-8 with a corrected
+//     Content-Type
+//   - multibyte encodings like GBK or Shift_JIS, whose characters may hold
+//     bytes in the ASCII range, have their characters masked as private use
+//     runes, so URLs and hosts only match on character boundaries, and are
+//     unmasked to the original bytes after rewriting
+
+// multibyte encodings, by their canonical name
+var multibyteCharsets = map[string]func(b []byte) int{
+	"shift_jis": shiftJISCharLen,
+	"gbk":       gbkCharLen,
+	"gb18030":   gbkCharLen,
+	"big5":      big5CharLen,
+	"euc-jp":    eucJPCharLen,
+	"euc-kr":    big5CharLen,
+}
+
+var charsetAliases = map[string]string{
+	"utf8": "utf-8", "unicode-1-1-utf-8": "utf-8",
+	"utf-16": "utf-16le", "ucs-2": "utf-16le", "unicode": "utf-16le",
+	"sjis": "shift_jis", "shift-jis": "shift_jis", "ms_kanji": "shift_jis", "windows-31j": "shift_jis",
+	"x-sjis": "shift_jis", "csshiftjis": "shift_jis", "ms932": "shift_jis", "cp932": "shift_jis",
+	"gb2312": "gbk", "gb_2312": "gbk", "chinese": "gbk", "csgb2312": "gbk", "x-gbk": "gbk", "cp936": "gbk",
+	"big5-hkscs": "big5", "x-x-big5": "big5", "cn-big5": "big5", "csbig5": "big5",
+	"x-euc-jp": "euc-jp", "cseucpkdfmtjapanese": "euc-jp",
+	"ks_c_5601-1987": "euc-kr", "korean": "euc-kr", "cp949": "euc-kr", "windows-949": "euc-kr",
+}
+
+func canonicalCharset(label string) string {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if alias, ok := charsetAliases[label]; ok {
+		return alias
+	}
+	return label
+}
+
+func isTextContent(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "/json") ||
+		strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "/javascript") ||
+		strings.HasSuffix(mediaType, "/ecmascript")
+}
+
+// detectCharset returns the canonical charset of a body: its BOM first, then
+// the charset of the Content-Type, then the <meta> of an HTML document.
+// It returns "" when unknown.
+func detectCharset(contentType string, body []byte) string {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if !isTextContent(mediaType) {
+		return canonicalCharset(params["charset"])
+	}
+
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	if charset := params["charset"]; charset != "" {
+		return canonicalCharset(charset)
+	}
+	if mediaType == "text/html" {
+		return canonicalCharset(metaCharset(body))
+	}
+	return ""
+}
+
+// metaCharset returns the charset declared by a <meta> in the first 1024
+// bytes of an HTML document.
+func metaCharset(body []byte) string {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	for i := 0; i < len(body); {
+		k := bytes.IndexByte(body[i:], '<')
+		if k < 0 {
+			break
+		}
+		i += k
+		if i+5 >= len(body) || !bytes.EqualFold(body[i+1:i+5], []byte("meta")) || !isSpace(body[i+5]) {
+			i++
+			continue
+		}
+		tag, end := parseTag(body, i)
+		if charset := tag.attr("charset"); charset != "" {
+			return charset
+		}
+		if content := tag.attr("content"); strings.EqualFold(tag.attr("http-equiv"), "content-type") {
+			if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+				return params["charset"]
+			}
+		}
+		i = end
+	}
+	return ""
+}
+
+// decodeBody returns the body ready for rewriting, and the function encoding
+// it back, with the Content-Type sent to the client, and whether the body
+// is masked: non-ASCII text added to it can't be encoded back.
+func decodeBody(contentType string, body []byte) ([]byte, func([]byte) []byte, string, bool) {
+	keep := func(b []byte) []byte { return b }
+	charset := detectCharset(contentType, body)
+
+	switch charset {
+	case "utf-16le", "utf-16be":
+		decoded, _, err := transform.Bytes(&utf16Decoder{bigEndian: charset == "utf-16be"}, body)
+		if err != nil {
+			return body, keep, contentType, false
+		}
+		return decoded, keep, setCharset(contentType, "utf-8"), false
+	}
+
+	if charLen, ok := multibyteCharsets[charset]; ok {
+		masked, _, err := transform.Bytes(&multibyteMasker{charLen: charLen}, body)
+		if err != nil {
+			return body, keep, contentType, false
+		}
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		html := mediaType == "text/html" || mediaType == "application/xhtml+xml"
+		return masked, func(b []byte) []byte {
+			unmasked, _, err := transform.Bytes(&multibyteUnmasker{html: html}, b)
+			if err != nil {
+				return b
+			}
+			return unmasked
+		}, contentType, true
+	}
+	return body, keep, contentType, false
+}
+
+func setCharset(contentType, charset string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// utf16Decoder decodes UTF-16 to UTF-8, dropping the BOM.
+type utf16Decoder struct {
+	transform.NopResetter
+	bigEndian bool
+	started   bool
+}
+
+func (p *utf16Decoder) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc+1 < len(src) {
+		u := p.unit(src[nSrc:])
+		size := 2
+		r := rune(u)
+		if utf16.IsSurrogate(r) {
+			if nSrc+3 >= len(src) {
+				if !atEOF {
+					return nDst, nSrc, transform.ErrShortSrc
+				}
+				r = utf8.RuneError
+			} else {
+				r = utf16.DecodeRune(r, rune(p.unit(src[nSrc+2:])))
+				if r != utf8.RuneError {
+					size = 4
+				}
+			}
+		}
+		if !p.started {
+			p.started = true
+			if r == 0xFEFF {
+				nSrc += size
+				continue
+			}
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += size
+	}
+	if nSrc < len(src) {
+		if !atEOF {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		// odd trailing byte
+		if nDst+3 > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], utf8.RuneError)
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+func (p *utf16Decoder) unit(b []byte) uint16 {
+	if p.bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return uint16(b[1])<<8 | uint16(b[0])
+}
+
+// Masked bytes are the private use runes U+F0000 to U+F00FF.
+const maskBase = 0xF0000
+
+// multibyteMasker masks every byte of the multibyte characters, ASCII
+// characters are kept.
+type multibyteMasker struct {
+	transform.NopResetter
+	charLen func(b []byte) int
+}
+
+func (p *multibyteMasker) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		c := src[nSrc]
+		if c < 0x80 {
+			if nDst >= len(dst) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			dst[nDst] = c
+			nDst++
+			nSrc++
+			continue
+		}
+		n := p.charLen(src[nSrc:])
+		if nSrc+n > len(src) {
+			if !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			n = len(src) - nSrc
+		}
+		if nDst+4*n > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		for _, b := range src[nSrc : nSrc+n] {
+			nDst += utf8.EncodeRune(dst[nDst:], maskBase+rune(b))
+		}
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// multibyteUnmasker restores the masked bytes. Other characters above ASCII,
+// added by rewriting, can't be encoded without tables, they become character
+// references in HTML and "?" elsewhere.
+type multibyteUnmasker struct {
+	transform.NopResetter
+	html bool
+}
+
+func (p *multibyteUnmasker) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		c := src[nSrc]
+		if c < 0x80 {
+			if nDst >= len(dst) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			dst[nDst] = c
+			nDst++
+			nSrc++
+			continue
+		}
+		if !utf8.FullRune(src[nSrc:]) && !atEOF {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		r, size := utf8.DecodeRune(src[nSrc:])
+		var out []byte
+		switch {
+		case r >= maskBase && r <= maskBase+0xFF:
+			out = []byte{byte(r - maskBase)}
+		case p.html:
+			out = []byte("&#" + strconv.Itoa(int(r)) + ";")
+		default:
+			out = []byte("?")
+		}
+		if nDst+len(out) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], out)
+		nSrc += size
+	}
+	return nDst, nSrc, nil
+}
+
+// The character lengths by lead byte, b[0] >= 0x80.
+
+func shiftJISCharLen(b []byte) int {
+	c := b[0]
+	if (c >= 0x81 && c <= 0x9F) || (c >= 0xE0 && c <= 0xFC) {
+		return 2
+	}
+	// half width katakana and invalid bytes
+	return 1
+}
+
+func gbkCharLen(b []byte) int {
+	if b[0] == 0x80 || b[0] == 0xFF {
+		return 1
+	}
+	// GB18030 four bytes sequences have a digit as second byte
+	if len(b) > 1 && b[1] >= 0x30 && b[1] <= 0x39 {
+		return 4
+	}
+	return 2
+}
+
+func big5CharLen(b []byte) int {
+	if b[0] == 0x80 || b[0] == 0xFF {
+		return 1
+	}
+	return 2
+}
+
+func eucJPCharLen(b []byte) int {
+	switch c := b[0]; {
+	case c == 0x8E:
+		return 2
+	case c == 0x8F:
+		return 3
+	case c >= 0xA1 && c <= 0xFE:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,151 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/transform"
+)
+
+func TestDetectCharset(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"text/html; charset=UTF-8", "", "utf-8"},
+		{"text/html; charset=Shift_JIS", "", "shift_jis"},
+		{"text/html; charset=\"gb2312\"", "", "gbk"},
+		{"text/css; charset=cp932", "", "shift_jis"},
+		{"text/html", "\xEF\xBB\xBF<p>", "utf-8"},
+		{"text/html; charset=gbk", "\xFF\xFEa\x00", "utf-16le"},
+		{"text/plain", "\xFE\xFF\x00a", "utf-16be"},
+		{"text/html", `<meta charset="big5">`, "big5"},
+		{"text/html", `<META http-equiv="Content-Type" content="text/html; charset=EUC-JP">`, "euc-jp"},
+		{"text/html", `<metadata charset="big5">`, ""},
+		{"text/css", `<meta charset="big5">`, ""},
+		{"image/png", "\xFF\xFE", ""},
+		{"application/json; charset=utf-16", "", "utf-16le"},
+	}
+	for _, tt := range tests {
+		if got := detectCharset(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("%q %q: got %q, want %q", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestMetaCharsetFirstKilobyte(t *testing.T) {
+	body := strings.Repeat(" ", 1024) + `<meta charset="gbk">`
+	if got := metaCharset([]byte(body)); got != "" {
+		t.Errorf("got %q after 1024 bytes", got)
+	}
+}
+
+func TestMultibyteMasking(t *testing.T) {
+	tests := []struct {
+		charset string
+		in      string
+	}{
+		// 表 has the trail byte "\"
+		{"shift_jis", "\x95\x5C/x.twitter.com/"},
+		{"shift_jis", "\xB1\x81@twitter.com"}, // half-width katakana, then a double byte
+		{"gbk", "\x81\x5Ctwitter.com\x81"},    // truncated last character
+		{"big5", "\xA5\x5C/twitter.com"},
+		{"euc-jp", "\x8E\xB1\x8F\xB0\xA1twitter.com"},
+	}
+	for _, tt := range tests {
+		masked, _, err := transform.Bytes(&multibyteMasker{charLen: multibyteCharsets[tt.charset]}, []byte(tt.in))
+		if err != nil {
+			t.Errorf("%v %q: %v", tt.charset, tt.in, err)
+			continue
+		}
+		if bytes.ContainsAny(masked, "\\@") || !bytes.Contains(masked, []byte("twitter.com")) {
+			t.Errorf("%v %q: masked to %q", tt.charset, tt.in, masked)
+		}
+		unmasked, _, err := transform.Bytes(&multibyteUnmasker{}, masked)
+		if err != nil || string(unmasked) != tt.in {
+			t.Errorf("%v %q: unmasked to %q, %v", tt.charset, tt.in, unmasked, err)
+		}
+	}
+}
+
+func TestMultibyteUnmaskAdded(t *testing.T) {
+	tests := []struct {
+		html bool
+		in   string
+		want string
+	}{
+		{true, "a日b", "a&#26085;b"},
+		{false, "a日b", "a?b"},
+		{false, "\U000F0095\U000F005C", "\x95\x5C"},
+	}
+	for _, tt := range tests {
+		got, _, err := transform.Bytes(&multibyteUnmasker{html: tt.html}, []byte(tt.in))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q html %v: got %q, %v, want %q", tt.in, tt.html, got, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeUTF16(t *testing.T) {
+	tests := []struct {
+		contentType string
+		in          string
+		want        string
+	}{
+		{"text/html", "\xFF\xFEa\x00\xE5\x65", "a日"},
+		{"text/html", "\xFE\xFF\x00a\xD8\x3D\xDE\x00", "a\U0001F600"},
+		{"text/plain; charset=utf-16le", "a\x00b\x00", "ab"},
+		{"text/plain; charset=utf-16le", "a\x00b", "a\uFFFD"},        // odd trailing byte
+		{"text/plain; charset=utf-16le", "a\x00\x3D\xD8", "a\uFFFD"}, // lone surrogate
+	}
+	for _, tt := range tests {
+		got, _, contentType, multibyte := decodeBody(tt.contentType, []byte(tt.in))
+		if string(got) != tt.want || !strings.Contains(contentType, "charset=utf-8") || multibyte {
+			t.Errorf("%q: got %q %q %v, want %q", tt.in, got, contentType, multibyte, tt.want)
+		}
+	}
+}
+
+func TestMultibyteRulesAndInjections(t *testing.T) {
+	rewriter := newTestRewriter(DomainMapping{
+		Rules: []Rule{
+			{Find: "Hello", Replace: "Bye"},
+			{Find: "Hello", Replace: "こんにちは"},
+			{Find: "表", Replace: "X"},
+		},
+		Inject: []Injection{
+			{Position: InjectBodyEnd, HTML: "<i>ascii</i>"},
+			{Position: InjectBodyEnd, HTML: "<i>日本</i>"},
+		},
+	})
+	proxy := &ReverseProxy{MapGroup: *rewriter.group}
+
+	in := "<body>Hello \x95\x5C<a href=\"https://twitter.com/\x95\x5C\"></body>"
+	got, _ := proxy.rewriteBody(rewriter, "https://twitter.com/", "/", "text/html; charset=shift_jis", strings.NewReader(in))
+	want := "<body>Bye \x95\x5C<a href=\"//t.byteio.cn/\x95\x5C\"><i>ascii</i><i>&#26085;&#26412;</i></body>"
+	if string(got) != want {
+		t.Errorf("shift_jis: got %q, want %q", got, want)
+	}
+
+	got, _ = proxy.rewriteBody(rewriter, "https://twitter.com/", "/", "application/xhtml+xml; charset=shift_jis", strings.NewReader(in))
+	if string(got) != want {
+		t.Errorf("xhtml shift_jis: got %q, want %q", got, want)
+	}
+
+	// non-ASCII replacements are left out of the other bodies
+	in = "Hello \x95\x5C"
+	got, _ = proxy.rewriteBody(rewriter, "https://twitter.com/", "/", "text/plain; charset=shift_jis", strings.NewReader(in))
+	want = "Bye \x95\x5C"
+	if string(got) != want {
+		t.Errorf("text shift_jis: got %q, want %q", got, want)
+	}
+
+	in = "<body>Hello 表<a href=\"https://twitter.com/表\"></body>"
+	got, _ = proxy.rewriteBody(rewriter, "https://twitter.com/", "/", "text/html; charset=utf-8", strings.NewReader(in))
+	want = "<body>Bye X<a href=\"//t.byteio.cn/X\"><i>ascii</i><i>日本</i></body>"
+	if string(got) != want {
+		t.Errorf("utf-8: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errCoalesceTimeout = errors.New("timeout waiting for coalesced request")
+
+// flightGroup coalesces concurrent upstream fetches of the same cache key,
+// like golang.org/x/sync/singleflight, so a popular page is fetched and
+// rewritten only once.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	resp  *proxyResponse
+	entry *CacheEntry
+	err   error
+}
+
+// do runs fn once for concurrent callers with the same key. Callers other
+// than the first one wait at most timeout, and shared tells them the result
+// is not theirs.
+func (g *flightGroup) do(key string, timeout time.Duration, fn func() (*proxyResponse, *CacheEntry, error)) (resp *proxyResponse, entry *CacheEntry, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-c.done:
+			return c.resp, c.entry, true, c.err
+		case <-timer.C:
+			return nil, nil, true, errCoalesceTimeout
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.entry, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.resp, c.entry, false, c.err
+}
+
+// flightKey is the cache key plus the request headers the stored entry varies on.
+func flightKey(req *http.Request, stored *CacheEntry) string {
+	key := cacheKey(req)
+	if stored == nil || len(stored.Vary) == 0 {
+		return key
+	}
+	names := make([]string, 0, len(stored.Vary))
+	for k := range stored.Vary {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		key += "\n" + k + ": " + req.Header.Get(k)
+	}
+	return key
+}
+
+// fetchCoalesced is fetchCached where concurrent identical requests share
+// one upstream fetch. Only cacheable results are shared, the waiters fetch
+// by themselves otherwise, or when the wait times out. The waiters sharing
+// the result get the stored entry and shared is true.
+func (p *ReverseProxy) fetchCoalesced(req, outreq *http.Request, stored *CacheEntry, mapping *DomainMapping) (resp *proxyResponse, entry *CacheEntry, shared bool, err error) {
+	if p.CoalesceTimeout <= 0 || req.Method != "GET" {
+		resp, entry, err = p.fetchCached(req, outreq, stored, mapping)
+		return resp, entry, false, err
+	}
+
+	// the fetch must not fail with the client who happens to start it
+	detached := outreq.WithContext(context.WithValue(context.Background(), mappingContextKey{}, mapping))
+	resp, entry, shared, err = p.flights.do(flightKey(req, stored), p.CoalesceTimeout, func() (*proxyResponse, *CacheEntry, error) {
+		return p.fetchCached(req, detached, stored, mapping)
+	})
+	if !shared {
+		return resp, entry, false, err
+	}
+
+	if err == nil && entry != nil && entry.matchVary(req) {
+		// resp belongs to the first caller, the others are served from the entry
+		return nil, entry, true, nil
+	}
+	if err == errCoalesceTimeout {
+		p.logf("http: %v %v", err, cacheKey(req))
+	}
+	resp, entry, err = p.fetchCached(req, outreq, stored, mapping)
+	return resp, entry, false, err
+}
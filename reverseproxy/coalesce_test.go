@@ -0,0 +1,197 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTransport counts the requests sent upstream.
+type countingTransport struct {
+	http.RoundTripper
+	hits int64
+}
+
+func (p *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&p.hits, 1)
+	return p.RoundTripper.RoundTrip(req)
+}
+
+// newCoalesceProxy returns a proxy of the upstream coalescing its requests,
+// with the transport counting them.
+func newCoalesceProxy(t *testing.T, upstream string) (*ReverseProxy, *countingTransport) {
+	proxy := newTestProxy(t, upstream, DomainMapping{})
+	proxy.CoalesceTimeout = 10 * time.Second
+	transport := &countingTransport{RoundTripper: proxy.Transport}
+	proxy.Transport = transport
+	return proxy, transport
+}
+
+// waitHits waits until the transport has sent n requests.
+func waitHits(t *testing.T, transport *countingTransport, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&transport.hits) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v requests sent upstream, want %v", atomic.LoadInt64(&transport.hits), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceConcurrentGets(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+	proxy, transport := newCoalesceProxy(t, upstream.URL)
+
+	const n = 10
+	results := make(chan *httptest.ResponseRecorder, n)
+	go func() { results <- testGet(proxy, "/", nil) }()
+	waitHits(t, transport, 1)
+	for i := 1; i < n; i++ {
+		go func() { results <- testGet(proxy, "/", nil) }()
+	}
+	// the waiters join the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < n; i++ {
+		rw := <-results
+		if rw.Code != 200 || rw.Body.String() != "page" {
+			t.Errorf("got %v %q", rw.Code, rw.Body.String())
+		}
+	}
+	if hits := atomic.LoadInt64(&transport.hits); hits != 1 {
+		t.Errorf("%v requests sent upstream, want 1", hits)
+	}
+}
+
+func TestCoalesceVary(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Language") == "en" {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("page " + r.Header.Get("Accept-Language")))
+	}))
+	defer upstream.Close()
+	proxy, transport := newCoalesceProxy(t, upstream.URL)
+
+	var wg sync.WaitGroup
+	got := map[string]string{}
+	var mu sync.Mutex
+	get := func(name, lang string) {
+		defer wg.Done()
+		rw := testGet(proxy, "/", http.Header{"Accept-Language": {lang}})
+		mu.Lock()
+		got[name] = rw.Body.String()
+		mu.Unlock()
+	}
+	wg.Add(3)
+	go get("leader", "en")
+	waitHits(t, transport, 1)
+	go get("same", "en")
+	go get("other", "fr")
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	want := map[string]string{"leader": "page en", "same": "page en", "other": "page fr"}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("%v: got %q, want %q", name, got[name], body)
+		}
+	}
+	// the leader, and the waiter whose Accept-Language the entry doesn't match
+	if hits := atomic.LoadInt64(&transport.hits); hits != 2 {
+		t.Errorf("%v requests sent upstream, want 2", hits)
+	}
+}
+
+func TestCoalesceCancelledLeader(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+	proxy, transport := newCoalesceProxy(t, upstream.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("GET", "http://proxy.test/", nil).WithContext(ctx)
+		proxy.ProxyHTTP(httptest.NewRecorder(), req)
+		close(leader)
+	}()
+	waitHits(t, transport, 1)
+	waiter := make(chan *httptest.ResponseRecorder)
+	go func() { waiter <- testGet(proxy, "/", nil) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	rw := <-waiter
+	<-leader
+	if rw.Code != 200 || rw.Body.String() != "page" {
+		t.Errorf("waiter got %v %q", rw.Code, rw.Body.String())
+	}
+	if hits := atomic.LoadInt64(&transport.hits); hits != 1 {
+		t.Errorf("%v requests sent upstream, want 1", hits)
+	}
+}
+
+func TestCoalesceOnlyGets(t *testing.T) {
+	for _, method := range []string{"HEAD", "POST"} {
+		t.Run(method, func(t *testing.T) {
+			const n = 3
+			var arrived, timedOut int64
+			all := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// every request must reach upstream before any is answered
+				if atomic.AddInt64(&arrived, 1) == n {
+					close(all)
+				}
+				select {
+				case <-all:
+				case <-time.After(2 * time.Second):
+					atomic.AddInt64(&timedOut, 1)
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+			}))
+			defer upstream.Close()
+			proxy, transport := newCoalesceProxy(t, upstream.URL)
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest(method, "http://proxy.test/", strings.NewReader(""))
+					proxy.ProxyHTTP(httptest.NewRecorder(), req)
+				}()
+			}
+			wg.Wait()
+			if atomic.LoadInt64(&timedOut) > 0 {
+				t.Error("requests waited for each other")
+			}
+			if hits := atomic.LoadInt64(&transport.hits); hits != n {
+				t.Errorf("%v requests sent upstream, want %v", hits, n)
+			}
+		})
+	}
+}
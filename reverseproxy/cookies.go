@@ -0,0 +1,223 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Cookie domain policies.
+const (
+	CookieDomainMap  = "map"
+	CookieDomainDrop = "drop"
+)
+
+// CookieConfig tells how the cookies of a mapping are rewritten.
+type CookieConfig struct {
+	// Domain is "map", the default, to map the upstream domain to the proxy
+	// domain, or "drop" to make every cookie host-only
+	Domain string `json:"domain,omitempty"`
+
+	// PathPrefix is prepended to the path of the cookies
+	PathPrefix string `json:"path_prefix,omitempty"`
+
+	// NamePrefix is prepended to the name of the cookies, and removed from
+	// the cookies sent upstream, cookies without it are not sent upstream.
+	// Mirrored sites sharing a parent domain don't see each others' cookies.
+	NamePrefix string `json:"name_prefix,omitempty"`
+}
+
+func (p *CookieConfig) init() error {
+	switch p.Domain {
+	case "":
+		p.Domain = CookieDomainMap
+	case CookieDomainMap, CookieDomainDrop:
+	default:
+		return fmt.Errorf("cookies: unknown domain policy %q", p.Domain)
+	}
+	if p.PathPrefix != "" && !strings.HasPrefix(p.PathPrefix, "/") {
+		return fmt.Errorf("cookies: path_prefix must start with /")
+	}
+	return nil
+}
+
+// Cookies with these name prefixes require Secure, browsers reject them on
+// plain HTTP, so they are renamed there and renamed back upstream.
+var securePrefixes = [][2]string{
+	{"__Secure-", "__proxyany_secure-"},
+	{"__Host-", "__proxyany_host-"},
+}
+
+// rewriteSetCookies rewrites the Set-Cookie headers of an upstream response,
+// req is the request sent upstream.
+func (p *MapGroup) rewriteSetCookies(header http.Header, req *http.Request, mapping *DomainMapping) {
+	cookies := header["Set-Cookie"]
+	if len(cookies) == 0 {
+		return
+	}
+	secure := clientScheme(req) == "https"
+	for i, c := range cookies {
+		cookies[i] = p.rewriteSetCookie(c, mapping, secure)
+	}
+}
+
+func (p *MapGroup) rewriteSetCookie(raw string, mapping *DomainMapping, secure bool) string {
+	attrs := strings.Split(raw, ";")
+	config := &mapping.Cookies
+
+	// name=value
+	name := strings.TrimSpace(attrs[0])
+	if k := strings.Index(name, "="); k >= 0 {
+		name, attrs[0] = name[:k], name[k:]
+	} else {
+		attrs[0] = ""
+	}
+	hostOnly := strings.HasPrefix(name, "__Host-")
+	if !secure {
+		for _, prefix := range securePrefixes {
+			if strings.HasPrefix(name, prefix[0]) {
+				name = prefix[1] + name[len(prefix[0]):]
+			}
+		}
+	}
+	attrs[0] = config.NamePrefix + name + attrs[0]
+
+	out := []string{attrs[0]}
+	sameSiteNone, hasPath := false, false
+	for _, attr := range attrs[1:] {
+		key, value := strings.TrimSpace(attr), ""
+		if k := strings.Index(key, "="); k >= 0 {
+			key, value = strings.TrimSpace(key[:k]), strings.TrimSpace(key[k+1:])
+		}
+
+		switch strings.ToLower(key) {
+		case "domain":
+			if hostOnly {
+				continue
+			}
+			domain := p.cookieDomain(value, mapping)
+			if domain == "" {
+				continue
+			}
+			attr = " Domain=" + domain
+		case "path":
+			if hostOnly {
+				// must stay /
+				break
+			}
+			hasPath = true
+			attr = " Path=" + config.PathPrefix + mapping.stripBase(value)
+		case "secure", "partitioned":
+			// both need a secure context
+			if !secure {
+				continue
+			}
+		case "samesite":
+			if strings.EqualFold(value, "none") {
+				if !secure {
+					// None without Secure is rejected
+					attr = " SameSite=Lax"
+				} else {
+					sameSiteNone = true
+				}
+			}
+		}
+		out = append(out, attr)
+	}
+
+	// the default path of the browser is out of the prefix
+	if config.PathPrefix != "" && !hasPath && !hostOnly {
+		out = append(out, " Path="+config.PathPrefix+"/")
+	}
+
+	if sameSiteNone && secure {
+		hasSecure := false
+		for _, attr := range out[1:] {
+			if strings.EqualFold(strings.TrimSpace(attr), "secure") {
+				hasSecure = true
+			}
+		}
+		if !hasSecure {
+			out = append(out, " Secure")
+		}
+	}
+	return strings.Join(out, ";")
+}
+
+// cookieDomain returns the proxy domain of the upstream cookie domain, or ""
+// for a host-only cookie.
+func (p *MapGroup) cookieDomain(domain string, mapping *DomainMapping) string {
+	if mapping.Cookies.Domain == CookieDomainDrop {
+		return ""
+	}
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" {
+		return ""
+	}
+
+	// the domain of a mapped upstream, or of one of its subdomains
+	if found, host := p.proxyHost(domain); found != nil {
+		if found.wildcard && found.To != mapping.To {
+			// each host has its own proxy domain, no parent is shared
+			return ""
+		}
+		return stripPort(host)
+	}
+
+	// a parent domain of the upstream, like twitter.com for api.twitter.com,
+	// becomes the same parent of the proxy host, when they share the subdomains
+	to := strings.ToLower(mapping.To)
+	from := stripPort(strings.ToLower(mapping.From))
+	if strings.HasSuffix(to, "."+domain) {
+		sub := to[:len(to)-len(domain)]
+		if strings.HasPrefix(from, sub) && len(from) > len(sub) {
+			return from[len(sub):]
+		}
+	}
+	return ""
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// rewriteRequestCookies renames the cookies sent upstream, undoing the
+// renaming of rewriteSetCookie.
+func (p *DomainMapping) rewriteRequestCookies(header http.Header) {
+	values := header["Cookie"]
+	if len(values) == 0 {
+		return
+	}
+	prefix := p.Cookies.NamePrefix
+
+	var out []string
+	for _, line := range values {
+		for _, c := range strings.Split(line, ";") {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				continue
+			}
+			if prefix != "" {
+				if !strings.HasPrefix(c, prefix) {
+					continue
+				}
+				c = c[len(prefix):]
+			}
+			for _, secure := range securePrefixes {
+				if strings.HasPrefix(c, secure[1]) {
+					c = secure[0] + c[len(secure[1]):]
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	if len(out) == 0 {
+		header.Del("Cookie")
+		return
+	}
+	header.Set("Cookie", strings.Join(out, "; "))
+}
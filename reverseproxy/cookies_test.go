@@ -0,0 +1,78 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookies CookieConfig
+		secure  bool
+		in      string
+		out     string
+	}{
+		{"plain", CookieConfig{}, true,
+			"a=1", "a=1"},
+		{"domain mapped", CookieConfig{}, true,
+			"a=1; Domain=.twitter.com; Path=/", "a=1; Domain=t.byteio.cn; Path=/"},
+		{"subdomain of mapped", CookieConfig{}, true,
+			"a=1; domain=pbs.twimg.com", "a=1; Domain=pbs.img.byteio.cn"},
+		{"unmapped domain", CookieConfig{}, true,
+			"a=1; Domain=example.com; HttpOnly", "a=1; HttpOnly"},
+		{"domain dropped", CookieConfig{Domain: CookieDomainDrop}, true,
+			"a=1; Domain=twitter.com", "a=1"},
+		{"value with equals", CookieConfig{}, true,
+			"a=b=c; Path=/", "a=b=c; Path=/"},
+		{"no value", CookieConfig{}, true,
+			"flag; Secure", "flag; Secure"},
+		{"name prefix", CookieConfig{NamePrefix: "tw_"}, true,
+			"a=1", "tw_a=1"},
+		{"path prefix", CookieConfig{PathPrefix: "/tw"}, true,
+			"a=1; Path=/x", "a=1; Path=/tw/x"},
+		{"path prefix without path", CookieConfig{PathPrefix: "/tw"}, true,
+			"a=1; HttpOnly", "a=1; HttpOnly; Path=/tw/"},
+		{"host prefix keeps its path", CookieConfig{PathPrefix: "/tw"}, true,
+			"__Host-a=1; Secure; Path=/", "__Host-a=1; Secure; Path=/"},
+		{"secure dropped on http", CookieConfig{}, false,
+			"a=1; Secure; Partitioned", "a=1"},
+		{"secure prefix renamed on http", CookieConfig{}, false,
+			"__Secure-a=1; Secure", "__proxyany_secure-a=1"},
+		{"samesite none on http", CookieConfig{}, false,
+			"a=1; SameSite=None; Secure", "a=1; SameSite=Lax"},
+		{"samesite none gets secure", CookieConfig{}, true,
+			"a=1; SameSite=None", "a=1; SameSite=None; Secure"},
+		{"expires kept", CookieConfig{}, true,
+			"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestRewriter(DomainMapping{Cookies: tt.cookies})
+			if got := p.group.rewriteSetCookie(tt.in, p.mapping, tt.secure); got != tt.out {
+				t.Errorf("got  %v\nwant %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestCookies(t *testing.T) {
+	tests := []struct {
+		prefix string
+		in     []string
+		out    string
+	}{
+		{"", []string{"a=1; b=2"}, "a=1; b=2"},
+		{"", []string{"a=1", "__proxyany_host-b=2"}, "a=1; __Host-b=2"},
+		{"tw_", []string{"tw_a=1; other=2; tw___proxyany_secure-c=3"}, "a=1; __Secure-c=3"},
+		{"tw_", []string{"other=2"}, ""},
+	}
+	for _, tt := range tests {
+		mapping := &DomainMapping{Cookies: CookieConfig{NamePrefix: tt.prefix}}
+		header := http.Header{"Cookie": tt.in}
+		mapping.rewriteRequestCookies(header)
+		if got := header.Get("Cookie"); got != tt.out {
+			t.Errorf("%v %v: got %q, want %q", tt.prefix, tt.in, got, tt.out)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// rewriteCSS rewrites every URL of a stylesheet: url() in its quoted and
+// unquoted forms, @import strings and image-set() strings. The CSS is
+// tokenized just enough to tell URLs from other strings, comments and
+// escapes, see CSS Syntax Module Level 3.
+func (p *rewriter) rewriteCSS(css []byte) []byte {
+	var out bytes.Buffer
+	last := 0
+	// splice replaces css[start:end] in the output
+	splice := func(start, end int, replacement string) {
+		out.Write(css[last:start])
+		out.WriteString(replacement)
+		last = end
+	}
+	// rewriteString rewrites the URL of the string token css[start:end]
+	rewriteString := func(start, end int, terminated bool) {
+		if !terminated {
+			return
+		}
+		value := cssUnescape(css[start+1 : end-1])
+		if rewritten := p.rewriteURL(value); rewritten != value {
+			splice(start, end, cssQuote(rewritten, css[start]))
+		}
+	}
+
+	n := len(css)
+	depth := 0
+	imageSetDepth := 0
+	inImport := false
+	for i := 0; i < n; {
+		c := css[i]
+		switch {
+		case c == '/' && i+1 < n && css[i+1] == '*':
+			end := bytes.Index(css[i+2:], []byte("*/"))
+			if end < 0 {
+				i = n
+			} else {
+				i += 2 + end + 2
+			}
+
+		case c == '"' || c == '\'':
+			end, terminated := scanCSSString(css, i)
+			if inImport || (imageSetDepth > 0 && depth >= imageSetDepth) {
+				rewriteString(i, end, terminated)
+			}
+			i = end
+
+		case c == '@':
+			start := i + 1
+			end := scanCSSIdent(css, start)
+			if strings.EqualFold(cssUnescape(css[start:end]), "import") {
+				inImport = true
+			}
+			if end == start {
+				end++
+			}
+			i = end
+
+		case isCSSIdentStart(css, i):
+			start := i
+			end := scanCSSIdent(css, start)
+			i = end
+			if end >= n || css[end] != '(' {
+				continue
+			}
+			name := strings.ToLower(cssUnescape(css[start:end]))
+			i++
+			depth++
+
+			switch name {
+			case "image-set", "-webkit-image-set":
+				if imageSetDepth == 0 {
+					imageSetDepth = depth
+				}
+			case "url":
+				j := i
+				for j < n && isSpace(css[j]) {
+					j++
+				}
+				if j < n && (css[j] == '"' || css[j] == '\'') {
+					end, terminated := scanCSSString(css, j)
+					rewriteString(j, end, terminated)
+					i = end
+					continue
+				}
+				// unquoted url, up to the closing parenthesis
+				k := j
+				for k < n && css[k] != ')' {
+					if css[k] == '\\' {
+						k = skipCSSEscape(css, k)
+					} else {
+						k++
+					}
+				}
+				end := k
+				for end > j && isSpace(css[end-1]) {
+					end--
+				}
+				value := cssUnescape(css[j:end])
+				if rewritten := p.rewriteURL(value); rewritten != value {
+					splice(j, end, cssEscapeURL(rewritten))
+				}
+				i = k
+			}
+
+		case c == '\\':
+			i = skipCSSEscape(css, i)
+
+		case c == '(':
+			depth++
+			i++
+
+		case c == ')':
+			if depth == imageSetDepth {
+				imageSetDepth = 0
+			}
+			if depth > 0 {
+				depth--
+			}
+			i++
+
+		case c == ';' || c == '{' || c == '}':
+			inImport = false
+			i++
+
+		default:
+			i++
+		}
+	}
+
+	if last == 0 {
+		return css
+	}
+	out.Write(css[last:])
+	return out.Bytes()
+}
+
+func isCSSIdentStart(css []byte, i int) bool {
+	c := css[i]
+	if isASCIILetter(c) || c == '_' || c >= 0x80 {
+		return true
+	}
+	if c == '-' && i+1 < len(css) {
+		next := css[i+1]
+		return isASCIILetter(next) || next == '_' || next == '-' || next >= 0x80 || next == '\\'
+	}
+	return false
+}
+
+// scanCSSIdent returns the end of the identifier starting at css[i].
+func scanCSSIdent(css []byte, i int) int {
+	for i < len(css) {
+		c := css[i]
+		switch {
+		case isASCIILetter(c) || (c >= '0' && c <= '9') || c == '-' || c == '_' || c >= 0x80:
+			i++
+		case c == '\\' && i+1 < len(css) && css[i+1] != '\n':
+			i = skipCSSEscape(css, i)
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scanCSSString returns the end of the string token starting at the quote css[i],
+// the closing quote included, and whether the closing quote was found.
+func scanCSSString(css []byte, i int) (int, bool) {
+	quote := css[i]
+	i++
+	for i < len(css) {
+		switch css[i] {
+		case quote:
+			return i + 1, true
+		case '\\':
+			i = skipCSSEscape(css, i)
+		case '\n':
+			// bad string, ends at the newline
+			return i, false
+		default:
+			i++
+		}
+	}
+	return i, false
+}
+
+// skipCSSEscape returns the end of the escape starting at the backslash css[i].
+func skipCSSEscape(css []byte, i int) int {
+	i++
+	if i >= len(css) {
+		return i
+	}
+	if !isHexDigit(css[i]) {
+		_, size := utf8.DecodeRune(css[i:])
+		return i + size
+	}
+	for k := 0; k < 6 && i < len(css) && isHexDigit(css[i]); k++ {
+		i++
+	}
+	if i < len(css) && isSpace(css[i]) {
+		if css[i] == '\r' && i+1 < len(css) && css[i+1] == '\n' {
+			i++
+		}
+		i++
+	}
+	return i
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// cssUnescape decodes the escapes of an identifier, string or url value.
+func cssUnescape(raw []byte) string {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return string(raw)
+	}
+	var out strings.Builder
+	for i := 0; i < len(raw); {
+		if raw[i] != '\\' {
+			out.WriteByte(raw[i])
+			i++
+			continue
+		}
+		end := skipCSSEscape(raw, i)
+		esc := raw[i+1 : end]
+		switch {
+		case len(esc) == 0:
+		case esc[0] == '\n' || esc[0] == '\r' || esc[0] == '\f':
+			// line continuation in strings
+		case isHexDigit(esc[0]):
+			hex := strings.TrimRight(string(esc), " \t\n\r\f")
+			v, _ := strconv.ParseUint(hex, 16, 32)
+			r := rune(v)
+			if r == 0 || r > utf8.MaxRune || (r >= 0xD800 && r <= 0xDFFF) {
+				r = utf8.RuneError
+			}
+			out.WriteRune(r)
+		default:
+			out.Write(esc)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// cssQuote returns the value as a CSS string token.
+func cssQuote(value string, quote byte) string {
+	var out strings.Builder
+	out.WriteByte(quote)
+	for _, r := range value {
+		switch {
+		case r == rune(quote) || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n' || r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, "\\%x ", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte(quote)
+	return out.String()
+}
+
+// cssEscapeURL escapes the value of an unquoted url().
+func cssEscapeURL(value string) string {
+	var out strings.Builder
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\'' || r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r <= 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, "\\%x ", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,104 @@
+package reverseproxy
+
+import (
+	"testing"
+)
+
+func TestRewriteCSS(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"unquoted url",
+			`a{background:url(https://twimg.com/a.png)}`,
+			`a{background:url(//img.byteio.cn/a.png)}`},
+		{"quoted url",
+			`a{background:url( "https://twimg.com/a.png" )}`,
+			`a{background:url( "//img.byteio.cn/a.png" )}`},
+		{"import string",
+			`@import "https://twitter.com/a.css";`,
+			`@import "//t.byteio.cn/a.css";`},
+		{"import url",
+			`@import url('https://twitter.com/a.css') screen;`,
+			`@import url('//t.byteio.cn/a.css') screen;`},
+		{"image-set",
+			`a{background:image-set("https://twimg.com/a.png" 1x, url(https://twimg.com/b.png) 2x)}`,
+			`a{background:image-set("//img.byteio.cn/a.png" 1x, url(//img.byteio.cn/b.png) 2x)}`},
+		{"other strings",
+			`a::after{content:"https://twitter.com/"}`,
+			`a::after{content:"https://twitter.com/"}`},
+		{"comment",
+			`/* url(https://twimg.com/a.png) */a{}`,
+			`/* url(https://twimg.com/a.png) */a{}`},
+		{"escaped function name",
+			`a{background:u\72l(https://twimg.com/a.png)}`,
+			`a{background:u\72l(//img.byteio.cn/a.png)}`},
+		{"escaped url",
+			`a{background:url(https\3a //twimg.com/a.png)}`,
+			`a{background:url(//img.byteio.cn/a.png)}`},
+		{"quote in rewritten string",
+			`a{background:url("https://twimg.com/a\"b.png")}`,
+			`a{background:url("//img.byteio.cn/a\"b.png")}`},
+		{"unterminated string",
+			`@import "https://twitter.com/a.css`,
+			`@import "https://twitter.com/a.css`},
+		{"import ends at semicolon",
+			`@import "a.css"; a{content:"https://twitter.com/"}`,
+			`@import "a.css"; a{content:"https://twitter.com/"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestRewriter(DomainMapping{})
+			if got := string(p.rewriteCSS([]byte(tt.in))); got != tt.out {
+				t.Errorf("got  %v\nwant %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestCSSUnescape(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{`plain`, `plain`},
+		{`\72 l`, `rl`},
+		{`\000072l`, `rl`},
+		{`a\"b`, `a"b`},
+		{"a\\\nb", `ab`},
+		{`\0`, "�"},
+		{`\D800`, "�"},
+		{`\1F600`, "\U0001F600"},
+	}
+	for _, tt := range tests {
+		if got := cssUnescape([]byte(tt.in)); got != tt.out {
+			t.Errorf("cssUnescape(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestCSSQuote(t *testing.T) {
+	tests := []struct {
+		in    string
+		quote byte
+		out   string
+		url   string
+	}{
+		{`//a/b`, '"', `"//a/b"`, `//a/b`},
+		{`a"b'c`, '"', `"a\"b'c"`, `a\"b\'c`},
+		{`a"b'c`, '\'', `'a"b\'c'`, `a\"b\'c`},
+		{"a\nb c", '"', `"a\a b c"`, `a\a b\20 c`},
+		{`a(b)\`, '"', `"a(b)\\"`, `a\(b\)\\`},
+	}
+	for _, tt := range tests {
+		if got := cssQuote(tt.in, tt.quote); got != tt.out {
+			t.Errorf("cssQuote(%q) = %v, want %v", tt.in, got, tt.out)
+		}
+		if got := cssEscapeURL(tt.in); got != tt.url {
+			t.Errorf("cssEscapeURL(%q) = %v, want %v", tt.in, got, tt.url)
+		}
+		if got := cssUnescape([]byte(tt.out[1 : len(tt.out)-1])); got != tt.in {
+			t.Errorf("cssUnescape(cssQuote(%q)) = %q", tt.in, got)
+		}
+	}
+}
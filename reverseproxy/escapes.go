@@ -0,0 +1,80 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Escaped forms of URLs, enabled per mapping with "escapes".
+const (
+	EscapeJSON    = "json"    // https:\/\/twitter.com
+	EscapePercent = "percent" // https%3A%2F%2Ftwitter.com
+	EscapeUnicode = "unicode" // https:\u002F\u002Ftwitter.com
+)
+
+type replacement struct {
+	old, new []byte
+}
+
+func (p *DomainMapping) hasEscape(form string) bool {
+	for _, e := range p.Escapes {
+		if e == form {
+			return true
+		}
+	}
+	return false
+}
+
+func validateEscapes(mapping *DomainMapping) error {
+	for _, e := range mapping.Escapes {
+		switch e {
+		case EscapeJSON, EscapePercent, EscapeUnicode:
+		default:
+			return fmt.Errorf("mapping %v: unknown escape %q", mapping.From, e)
+		}
+	}
+	return nil
+}
+
+// escapedReplacements returns the escaped forms of "scheme://upstream",
+// mapped to the same form of "//proxy" like the literal form is rewritten,
+// and the unicode escaped forms of the bare upstream host.
+func escapedReplacements(mapping *DomainMapping) []replacement {
+	var rv []replacement
+	add := func(old, new string) {
+		rv = append(rv, replacement{[]byte(old), []byte(new)})
+	}
+	from, to := mapping.From, mapping.To
+
+	if mapping.hasEscape(EscapeJSON) {
+		for _, scheme := range []string{"https:", "http:"} {
+			add(scheme+`\/\/`+to, `\/\/`+from)
+		}
+	}
+
+	if mapping.hasEscape(EscapePercent) {
+		for _, slash := range []string{"%2F", "%2f"} {
+			for _, colon := range []string{"%3A", "%3a"} {
+				for _, scheme := range []string{"https", "http"} {
+					add(scheme+colon+slash+slash+to, slash+slash+from)
+				}
+			}
+		}
+	}
+
+	if mapping.hasEscape(EscapeUnicode) {
+		for _, dot := range []string{".", `\u002E`, `\u002e`} {
+			escTo := strings.Replace(to, ".", dot, -1)
+			escFrom := strings.Replace(from, ".", dot, -1)
+			for _, slash := range []string{`\u002F`, `\u002f`} {
+				for _, scheme := range []string{"https:", "http:"} {
+					add(scheme+slash+slash+escTo, slash+slash+escFrom)
+				}
+			}
+			if dot != "." && escTo != to {
+				add(escTo, escFrom)
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,49 @@
+package reverseproxy
+
+import (
+	"testing"
+)
+
+func TestEscapedReplacements(t *testing.T) {
+	tests := []struct {
+		escapes []string
+		in      string
+		out     string
+	}{
+		// the bare host only
+		{nil, `"https:\/\/twitter.com\/a"`, `"https:\/\/t.byteio.cn\/a"`},
+		{[]string{EscapeJSON}, `"https:\/\/twitter.com\/a"`, `"\/\/t.byteio.cn\/a"`},
+		{[]string{EscapeJSON}, `"http:\/\/twitter.com"`, `"\/\/t.byteio.cn"`},
+		{[]string{EscapePercent}, `?next=https%3A%2F%2Ftwitter.com%2Fa`, `?next=%2F%2Ft.byteio.cn%2Fa`},
+		{[]string{EscapePercent}, `?next=http%3a%2f%2ftwitter.com`, `?next=%2f%2ft.byteio.cn`},
+		{[]string{EscapeUnicode}, `"https:\u002F\u002Ftwitter.com"`, `"\u002F\u002Ft.byteio.cn"`},
+		{[]string{EscapeUnicode}, `"http:\u002f\u002ftwitter\u002ecom"`, `"\u002f\u002ft\u002ebyteio\u002ecn"`},
+		{[]string{EscapeUnicode}, `host: "twitter\u002Ecom"`, `host: "t\u002Ebyteio\u002Ecn"`},
+		// the literal form is always rewritten
+		{[]string{EscapeJSON}, `https://twitter.com/a`, `//t.byteio.cn/a`},
+	}
+	for _, tt := range tests {
+		p := newTestRewriter(DomainMapping{Escapes: tt.escapes})
+		if got := string(p.replace([]byte(tt.in))); got != tt.out {
+			t.Errorf("%v %v: got %v, want %v", tt.escapes, tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestValidateEscapes(t *testing.T) {
+	tests := []struct {
+		escapes []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{EscapeJSON, EscapePercent, EscapeUnicode}, true},
+		{[]string{"base64"}, false},
+		{[]string{"JSON"}, false},
+	}
+	for _, tt := range tests {
+		err := validateEscapes(&DomainMapping{Escapes: tt.escapes})
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: %v", tt.escapes, err)
+		}
+	}
+}
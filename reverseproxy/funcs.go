@@ -3,6 +3,7 @@ package reverseproxy
 import (
 	"net"
 	"net/http"
+	"path"
 	"strings"
 )
 
@@ -81,3 +82,28 @@ outer:
 		}
 	}
 }
+
+// matchPath reports whether the URL path matches the glob pattern,
+// a trailing "*" also matches everything after it, slashes included.
+func matchPath(pattern, p string) bool {
+	if ok, _ := path.Match(pattern, p); ok {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(p, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// clientScheme returns the scheme the client used to reach the proxy,
+// X-Forwarded-Proto is trusted when the proxy runs behind another one.
+func clientScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	proto := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0])
+	if strings.EqualFold(proto, "https") {
+		return "https"
+	}
+	return "http"
+}
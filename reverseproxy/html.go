@@ -0,0 +1,368 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// attributes holding an URL
+var urlAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "poster": true,
+	"cite": true, "background": true, "longdesc": true, "manifest": true,
+	"icon": true, "codebase": true, "data": true, "xlink:href": true,
+}
+
+// attributes holding visible text
+var textAttrs = map[string]bool{
+	"alt": true, "title": true, "placeholder": true, "label": true, "value": true,
+}
+
+// elements whose content is raw text, not HTML
+var rawTextElements = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true, "xmp": true,
+}
+
+type htmlAttr struct {
+	name       string
+	start      int // offsets of the attribute in the raw tag
+	end        int
+	valueStart int // offsets of the value in the raw tag, quotes excluded
+	valueEnd   int
+	quote      byte
+	hasValue   bool
+}
+
+type htmlTag struct {
+	raw   []byte
+	name  string
+	attrs []htmlAttr
+}
+
+func (p *htmlTag) attr(name string) string {
+	for _, a := range p.attrs {
+		if a.name == name && a.hasValue {
+			return html.UnescapeString(string(p.raw[a.valueStart:a.valueEnd]))
+		}
+	}
+	return ""
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// parseTag parses the start tag at body[start], which is '<'.
+// It returns the tag and the offset after it.
+func parseTag(body []byte, start int) (*htmlTag, int) {
+	n := len(body)
+	i := start + 1
+	for i < n && !isSpace(body[i]) && body[i] != '/' && body[i] != '>' {
+		i++
+	}
+	tag := &htmlTag{name: strings.ToLower(string(body[start+1 : i]))}
+
+	for i < n {
+		for i < n && (isSpace(body[i]) || body[i] == '/') {
+			i++
+		}
+		if i >= n || body[i] == '>' {
+			break
+		}
+
+		nameStart := i
+		for i < n && !isSpace(body[i]) && body[i] != '/' && body[i] != '>' && body[i] != '=' {
+			i++
+		}
+		if i == nameStart {
+			// a stray '=', skip it
+			i++
+			continue
+		}
+		attr := htmlAttr{name: strings.ToLower(string(body[nameStart:i])), start: nameStart}
+
+		j := i
+		for j < n && isSpace(body[j]) {
+			j++
+		}
+		if j < n && body[j] == '=' {
+			j++
+			for j < n && isSpace(body[j]) {
+				j++
+			}
+			attr.hasValue = true
+			if j < n && (body[j] == '"' || body[j] == '\'') {
+				attr.quote = body[j]
+				end := bytes.IndexByte(body[j+1:], attr.quote)
+				if end < 0 {
+					end = n - j - 1
+				}
+				attr.valueStart, attr.valueEnd = j+1, j+1+end
+				i = attr.valueEnd + 1
+			} else {
+				attr.valueStart = j
+				for j < n && !isSpace(body[j]) && body[j] != '>' {
+					j++
+				}
+				attr.valueEnd = j
+				i = j
+			}
+		}
+		attr.end = i
+		if attr.end > n {
+			attr.end = n
+		}
+		tag.attrs = append(tag.attrs, attr)
+	}
+
+	end := i + 1
+	if end > n {
+		end = n
+	}
+	tag.raw = body[start:end]
+	for k := range tag.attrs {
+		tag.attrs[k].start -= start
+		tag.attrs[k].end -= start
+		tag.attrs[k].valueStart -= start
+		tag.attrs[k].valueEnd -= start
+	}
+	return tag, end
+}
+
+// indexCloseTag returns the offset of the closing tag of a raw text element.
+func indexCloseTag(body []byte, from int, name string) int {
+	closing := []byte("</" + name)
+	for i := from; i < len(body); {
+		k := bytes.IndexByte(body[i:], '<')
+		if k < 0 {
+			break
+		}
+		i += k
+		if len(body)-i >= len(closing) && bytes.EqualFold(body[i:i+len(closing)], closing) {
+			after := i + len(closing)
+			if after == len(body) || isSpace(body[after]) || body[after] == '>' || body[after] == '/' {
+				return i
+			}
+		}
+		i++
+	}
+	return len(body)
+}
+
+// rewriteHTML rewrites the URLs found in tags of the HTML document, the
+// inline styles and style blocks, and scripts. Text is left alone unless
+// the mapping asks for it. The injections of the mapping are inserted.
+func (p *rewriter) rewriteHTML(body []byte) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(body)+len(body)/8))
+	injector := &htmlInjector{mapping: p.mapping}
+	n := len(body)
+	i := 0
+	for i < n {
+		lt := bytes.IndexByte(body[i:], '<')
+		if lt < 0 {
+			p.writeText(out, body[i:])
+			break
+		}
+		p.writeText(out, body[i:i+lt])
+		i += lt
+
+		switch {
+		case bytes.HasPrefix(body[i:], []byte("<!--")):
+			end := bytes.Index(body[i+4:], []byte("-->"))
+			if end < 0 {
+				end = n
+			} else {
+				end = i + 4 + end + 3
+			}
+			out.Write(body[i:end])
+			i = end
+			continue
+		case i+1 < n && (body[i+1] == '!' || body[i+1] == '?' || body[i+1] == '/'):
+			// doctype, processing instruction or end tag
+			end := bytes.IndexByte(body[i:], '>')
+			if end < 0 {
+				end = n
+			} else {
+				end = i + end + 1
+			}
+			if body[i+1] == '/' {
+				injector.endTag(out, endTagName(body[i:end]))
+			}
+			out.Write(body[i:end])
+			i = end
+			continue
+		case i+1 >= n || !isASCIILetter(body[i+1]):
+			out.WriteByte('<')
+			i++
+			continue
+		}
+
+		tag, end := parseTag(body, i)
+		injector.startTag(out, tag.name, p.rewriteTag(tag))
+		i = end
+
+		if rawTextElements[tag.name] {
+			closeAt := indexCloseTag(body, i, tag.name)
+			content := body[i:closeAt]
+			switch tag.name {
+			case "style":
+				out.Write(p.rewriteCSS(content))
+			case "script":
+				out.Write(p.replace(content))
+			default:
+				p.writeText(out, content)
+			}
+			i = closeAt
+		}
+	}
+	injector.end(out)
+	return out.Bytes()
+}
+
+// endTagName returns the lower case name of the end tag "</name>".
+func endTagName(raw []byte) string {
+	i := 2
+	for i < len(raw) && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+	return strings.ToLower(string(raw[2:i]))
+}
+
+func (p *rewriter) writeText(out *bytes.Buffer, text []byte) {
+	if p.mapping != nil && p.mapping.RewriteText {
+		text = p.replace(text)
+	}
+	out.Write(text)
+}
+
+// rewriteTag returns the raw tag with its attribute values rewritten.
+func (p *rewriter) rewriteTag(tag *htmlTag) []byte {
+	var out []byte
+	last := 0
+	for _, a := range tag.attrs {
+		if !a.hasValue {
+			continue
+		}
+		value := html.UnescapeString(string(tag.raw[a.valueStart:a.valueEnd]))
+		rewritten, remove := value, false
+		if a.name == "integrity" && (tag.name == "script" || tag.name == "link") {
+			rewritten, remove = p.rewriteIntegrity(tag, value)
+		} else {
+			rewritten = p.rewriteAttr(tag, a.name, value)
+		}
+		if rewritten == value && !remove {
+			continue
+		}
+
+		if out == nil {
+			out = make([]byte, 0, len(tag.raw)+64)
+		}
+		if remove {
+			out = append(out, bytes.TrimRight(tag.raw[last:a.start], " \t\n\r\f")...)
+			last = a.end
+			continue
+		}
+		escaped := escapeAttr(rewritten, a.quote)
+		if a.quote == 0 {
+			escaped = `"` + escaped + `"`
+		}
+		out = append(out, tag.raw[last:a.valueStart]...)
+		out = append(out, escaped...)
+		last = a.valueEnd
+	}
+	if out == nil {
+		return tag.raw
+	}
+	return append(out, tag.raw[last:]...)
+}
+
+var (
+	doubleQuotedEscaper = strings.NewReplacer("&", "&amp;", `"`, "&quot;")
+	singleQuotedEscaper = strings.NewReplacer("&", "&amp;", "'", "&#39;")
+)
+
+// escapeAttr escapes the attribute value for its quotes, unquoted values get double quotes.
+func escapeAttr(value string, quote byte) string {
+	if quote == '\'' {
+		return singleQuotedEscaper.Replace(value)
+	}
+	return doubleQuotedEscaper.Replace(value)
+}
+
+func (p *rewriter) rewriteAttr(tag *htmlTag, name, value string) string {
+	switch {
+	case urlAttrs[name]:
+		return p.rewriteURL(value)
+	case name == "srcset" || name == "imagesrcset":
+		return p.rewriteSrcset(value)
+	case name == "style":
+		return string(p.rewriteCSS([]byte(value)))
+	case name == "content" && tag.name == "meta":
+		if strings.EqualFold(tag.attr("http-equiv"), "refresh") {
+			return p.rewriteRefresh(value)
+		}
+		if looksLikeURL(value) {
+			return p.rewriteURL(value)
+		}
+	case strings.HasPrefix(name, "data-") && looksLikeURL(value):
+		return p.rewriteURL(value)
+	case textAttrs[name] && p.mapping != nil && p.mapping.RewriteText:
+		return string(p.replace([]byte(value)))
+	}
+	return value
+}
+
+// rewriteSrcset rewrites the URLs of the image candidates "url 2x, url 300w".
+func (p *rewriter) rewriteSrcset(value string) string {
+	var out strings.Builder
+	n := len(value)
+	i := 0
+	for i < n {
+		start := i
+		for i < n && (isSpace(value[i]) || value[i] == ',') {
+			i++
+		}
+		out.WriteString(value[start:i])
+
+		start = i
+		for i < n && !isSpace(value[i]) {
+			i++
+		}
+		u := value[start:i]
+		trailing := ""
+		for strings.HasSuffix(u, ",") {
+			u, trailing = u[:len(u)-1], trailing+","
+		}
+		out.WriteString(p.rewriteURL(u))
+		out.WriteString(trailing)
+		if trailing != "" {
+			continue
+		}
+
+		// descriptors, up to the next comma
+		start = i
+		for i < n && value[i] != ',' {
+			i++
+		}
+		out.WriteString(value[start:i])
+	}
+	return out.String()
+}
+
+// rewriteRefresh rewrites the URL of "5; url=https://example.com/".
+func (p *rewriter) rewriteRefresh(value string) string {
+	k := strings.Index(strings.ToLower(value), "url=")
+	if k < 0 {
+		return value
+	}
+	u := strings.TrimSpace(value[k+4:])
+	quote := ""
+	if len(u) > 1 && (u[0] == '\'' || u[0] == '"') && u[len(u)-1] == u[0] {
+		quote, u = u[:1], u[1:len(u)-1]
+	}
+	return value[:k+4] + quote + p.rewriteURL(u) + quote
+}
@@ -0,0 +1,116 @@
+package reverseproxy
+
+import (
+	"testing"
+)
+
+// newTestRewriter returns a rewriter of the mapping t.byteio.cn, twimg.com
+// being mapped too.
+func newTestRewriter(mapping DomainMapping) *rewriter {
+	mapping.From = "t.byteio.cn"
+	if mapping.To == "" {
+		mapping.To = "https://twitter.com"
+	}
+	group := NewMapGroup([]DomainMapping{mapping, {From: "img.byteio.cn", To: "https://twimg.com"}})
+	return &rewriter{group: group, mapping: &group.maps[0]}
+}
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		in    string
+		name  string
+		attrs map[string]string // values, "" without value
+		end   int
+	}{
+		{`<a href="/x">`, "a", map[string]string{"href": "/x"}, 13},
+		{`<A HREF='/x' Title=t>`, "a", map[string]string{"href": "/x", "title": "t"}, 21},
+		{`<img src=/a.png alt>rest`, "img", map[string]string{"src": "/a.png", "alt": ""}, 20},
+		{`<br/>`, "br", map[string]string{}, 5},
+		{`<input value = "a b" disabled />`, "input", map[string]string{"value": "a b", "disabled": ""}, 32},
+		{`<a href="/x&amp;y">`, "a", map[string]string{"href": "/x&y"}, 19},
+		{`<a =x href="/y">`, "a", map[string]string{"x": "", "href": "/y"}, 16},
+		{`<a href="/unterminated`, "a", map[string]string{"href": "/unterminated"}, 22},
+	}
+	for _, tt := range tests {
+		tag, end := parseTag([]byte(tt.in), 0)
+		if tag.name != tt.name || end != tt.end || len(tag.attrs) != len(tt.attrs) {
+			t.Errorf("%v: got %v %v %+v", tt.in, tag.name, end, tag.attrs)
+			continue
+		}
+		for _, a := range tag.attrs {
+			want, ok := tt.attrs[a.name]
+			if !ok || (want != "") != a.hasValue || tag.attr(a.name) != want {
+				t.Errorf("%v: attribute %v = %q", tt.in, a.name, tag.attr(a.name))
+			}
+		}
+	}
+}
+
+func TestRewriteHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text bool
+		in   string
+		out  string
+	}{
+		{"link", false,
+			`<a href="https://twitter.com/home">twitter.com</a>`,
+			`<a href="//t.byteio.cn/home">twitter.com</a>`},
+		{"text rewritten", true,
+			`<p title="twitter.com">see twitter.com</p>`,
+			`<p title="t.byteio.cn">see t.byteio.cn</p>`},
+		{"subdomain", false,
+			`<img src="https://pbs.twimg.com/a.png">`,
+			`<img src="//pbs.img.byteio.cn/a.png">`},
+		{"unquoted", false,
+			`<img src=https://twimg.com/a.png>`,
+			`<img src="//img.byteio.cn/a.png">`},
+		{"single quotes", false,
+			`<a href='https://twitter.com/?a=1&amp;b=2'>`,
+			`<a href='//t.byteio.cn/?a=1&amp;b=2'>`},
+		{"srcset", false,
+			`<img srcset="https://twimg.com/a.png 1x,https://twimg.com/b.png 2x">`,
+			`<img srcset="//img.byteio.cn/a.png 1x,//img.byteio.cn/b.png 2x">`},
+		{"refresh", false,
+			`<meta http-equiv="refresh" content="0; url=https://twitter.com/x">`,
+			`<meta http-equiv="refresh" content="0; url=//t.byteio.cn/x">`},
+		{"data attribute", false,
+			`<div data-src="https://twimg.com/a" data-name="twitter.com">`,
+			`<div data-src="//img.byteio.cn/a" data-name="twitter.com">`},
+		{"unmapped", false,
+			`<a href="https://example.com/">`,
+			`<a href="https://example.com/">`},
+		{"comment", false,
+			`<!-- <a href="https://twitter.com/"> -->`,
+			`<!-- <a href="https://twitter.com/"> -->`},
+		{"script", false,
+			`<script>fetch("https://twitter.com/api")</script>`,
+			`<script>fetch("//t.byteio.cn/api")</script>`},
+		{"textarea is text", false,
+			`<textarea><a href="https://twitter.com/"></textarea>`,
+			`<textarea><a href="https://twitter.com/"></textarea>`},
+		{"style", false,
+			`<style>a{background:url(https://twimg.com/a.png)}</style>`,
+			`<style>a{background:url(//img.byteio.cn/a.png)}</style>`},
+		{"stray less than", false,
+			`1 < 2 <a href="https://twitter.com/">`,
+			`1 < 2 <a href="//t.byteio.cn/">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestRewriter(DomainMapping{RewriteText: tt.text})
+			if got := string(p.rewriteHTML([]byte(tt.in))); got != tt.out {
+				t.Errorf("got  %v\nwant %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestRewriteHTMLBasePath(t *testing.T) {
+	p := newTestRewriter(DomainMapping{To: "https://twitter.com/base"})
+	in := `<a href="/base/x"><a href="/other"><a href="https://twitter.com/base/y">`
+	out := `<a href="/x"><a href="/other"><a href="//t.byteio.cn/y">`
+	if got := string(p.rewriteHTML([]byte(in))); got != out {
+		t.Errorf("got  %v\nwant %v", got, out)
+	}
+}
@@ -0,0 +1,464 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The caching rules follow RFC 9111 for a shared cache.
+
+// status codes which are heuristically cacheable, RFC 9110 section 15.1
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// StaleHeader is set on stale responses served from the cache or from
+// the recordings, its value is the staleness in seconds.
+const StaleHeader = "X-Cache-Stale"
+
+// heuristic freshness is 10% of the time since Last-Modified, capped here
+const maxHeuristicLifetime = 24 * time.Hour
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range header["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			k, v := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				k, v = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(k))] = v
+		}
+	}
+	return cc
+}
+
+func (p cacheControl) has(k string) bool {
+	_, ok := p[k]
+	return ok
+}
+
+func (p cacheControl) seconds(k string) (time.Duration, bool) {
+	v, ok := p[k]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// invalid values are treated as stale
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func cacheKey(req *http.Request) string {
+	return strings.ToLower(req.Host) + req.URL.RequestURI()
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// cacheableRequest reports whether the request may be answered from the cache.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if req.Header.Get("Range") != "" {
+		return false
+	}
+	return !parseCacheControl(req.Header).has("no-store")
+}
+
+// requestAllowsStored reports whether the request accepts the stored response
+// without revalidation.
+func requestAllowsStored(req *http.Request, entry *CacheEntry, now time.Time) bool {
+	if !entry.fresh(now) {
+		return false
+	}
+	cc := parseCacheControl(req.Header)
+	if cc.has("no-cache") || (len(cc) == 0 && req.Header.Get("Pragma") == "no-cache") {
+		return false
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok && entry.age(now) > maxAge {
+		return false
+	}
+	if minFresh, ok := cc.seconds("min-fresh"); ok && entry.Expires.Sub(now) < minFresh {
+		return false
+	}
+	return true
+}
+
+func (p *DomainMapping) cacheTTL(urlPath string) (time.Duration, bool) {
+	for _, o := range p.CacheTTL {
+		if matchPath(o.Path, urlPath) {
+			return o.TTL.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// freshnessLifetime returns the freshness lifetime of an upstream response
+// and whether a shared cache may store it.
+func freshnessLifetime(req *http.Request, statusCode int, header http.Header, mapping *DomainMapping, now time.Time) (time.Duration, bool) {
+	if req.Method != "GET" || statusCode < 200 || statusCode == http.StatusPartialContent || statusCode == http.StatusNotModified {
+		return 0, false
+	}
+
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return 0, false
+	}
+	for _, v := range header["Vary"] {
+		if strings.TrimSpace(v) == "*" {
+			return 0, false
+		}
+	}
+	// never share cookies between clients
+	if len(header["Set-Cookie"]) > 0 {
+		return 0, false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, false
+	}
+	// the override only applies to responses which may be shared
+	if ttl, ok := mapping.cacheTTL(req.URL.Path); ok {
+		return ttl, ttl > 0
+	}
+
+	date := now
+	if t, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = t
+	}
+
+	var lifetime time.Duration
+	if d, ok := cc.seconds("s-maxage"); ok {
+		lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		lifetime = d
+	} else if v := header.Get("Expires"); v != "" {
+		// invalid dates mean already expired
+		if t, err := http.ParseTime(v); err == nil {
+			lifetime = t.Sub(date)
+		}
+	} else {
+		if !heuristicStatus[statusCode] && !cc.has("public") {
+			return 0, false
+		}
+		if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil && date.After(t) {
+			lifetime = date.Sub(t) / 10
+			if lifetime > maxHeuristicLifetime {
+				lifetime = maxHeuristicLifetime
+			}
+		}
+	}
+
+	// no-cache responses may be stored, but are always revalidated
+	if lifetime < 0 || cc.has("no-cache") {
+		lifetime = 0
+	}
+	hasValidators := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	return lifetime, lifetime > 0 || hasValidators
+}
+
+// initialAge is the age of the response when received, from the Age header.
+func initialAge(header http.Header) time.Duration {
+	if n, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
+
+// newCacheEntry returns the entry to store for the upstream response,
+// nil if the response must not be stored. It must be called before
+// the response headers are rewritten.
+func newCacheEntry(req *http.Request, res *http.Response, mapping *DomainMapping, now time.Time) *CacheEntry {
+	// the response of another URL
+	if isFollowed(res) {
+		return nil
+	}
+	lifetime, ok := freshnessLifetime(req, res.StatusCode, res.Header, mapping, now)
+	if !ok {
+		return nil
+	}
+
+	entry := &CacheEntry{
+		Key:          cacheKey(req),
+		Mapping:      mapping.From,
+		StatusCode:   res.StatusCode,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+	entry.Stored = now.Add(-initialAge(res.Header))
+	entry.Expires = entry.Stored.Add(lifetime)
+
+	for _, line := range res.Header["Vary"] {
+		for _, k := range strings.Split(line, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			// we always talk gzip with upstream and send identity to the client
+			if k == "" || k == "Accept-Encoding" {
+				continue
+			}
+			if entry.Vary == nil {
+				entry.Vary = http.Header{}
+			}
+			entry.Vary.Set(k, req.Header.Get(k))
+		}
+	}
+	return entry
+}
+
+// revalidated returns a copy of the entry refreshed by a 304 response.
+func (p *CacheEntry) revalidated(req *http.Request, res *http.Response, mapping *DomainMapping, now time.Time) *CacheEntry {
+	entry := *p
+	entry.Header = p.Header.Clone()
+	for _, k := range []string{"Cache-Control", "Date", "Expires", "ETag", "Last-Modified"} {
+		if vv, ok := res.Header[k]; ok {
+			entry.Header[k] = vv
+		}
+	}
+	if v := res.Header.Get("ETag"); v != "" {
+		entry.ETag = v
+	}
+	if v := res.Header.Get("Last-Modified"); v != "" {
+		entry.LastModified = v
+	}
+
+	lifetime, _ := freshnessLifetime(req, p.StatusCode, entry.Header, mapping, now)
+	entry.Stored = now.Add(-initialAge(res.Header))
+	entry.Expires = entry.Stored.Add(lifetime)
+	return &entry
+}
+
+// notModified evaluates the client conditional request against the stored response.
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == "*" || v == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+// staleAllowed reports whether the expired entry may still be served,
+// the per mapping setting overrides the directive from upstream.
+func staleAllowed(entry *CacheEntry, directive string, override time.Duration, now time.Time) bool {
+	limit := override
+	if limit <= 0 {
+		cc := parseCacheControl(entry.Header)
+		if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache") {
+			return false
+		}
+		limit, _ = cc.seconds(directive)
+	}
+	return now.Sub(entry.Expires) <= limit
+}
+
+// isServerError reports whether stale-if-error applies to the status code.
+func isServerError(statusCode int) bool {
+	switch statusCode {
+	case 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+func (p *ReverseProxy) proxyCached(rw http.ResponseWriter, req, outreq *http.Request, mapping *DomainMapping) {
+	if !cacheableRequest(req) {
+		res, err := p.roundTrip(outreq)
+		if err != nil {
+			p.logf("http: proxy error 1: %v", err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		// a successful unsafe request invalidates the stored response
+		if !isSafeMethod(req.Method) && res.StatusCode < 400 {
+			p.Cache.Delete(cacheKey(req))
+		}
+		p.writeResponse(rw, req, p.rewriteResponse(res, mapping))
+		return
+	}
+
+	now := time.Now()
+	entry := p.Cache.Get(cacheKey(req))
+	if entry != nil && !entry.matchVary(req) {
+		entry = nil
+	}
+	// the hashes of the integrity attributes are outdated, the page is
+	// rewritten again
+	if entry != nil && !p.Cache.integrityValid(entry, now) {
+		entry = nil
+	}
+	if entry != nil && requestAllowsStored(req, entry, now) {
+		p.serveEntry(rw, req, entry, "HIT")
+		return
+	}
+
+	// revalidate the stored response
+	if entry != nil {
+		outreq.Header.Del("If-None-Match")
+		outreq.Header.Del("If-Modified-Since")
+		if entry.ETag != "" {
+			outreq.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			outreq.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+
+		// a fresh entry was refused by the client, it is never served stale
+		if !entry.fresh(now) && !parseCacheControl(req.Header).has("no-cache") &&
+			staleAllowed(entry, "stale-while-revalidate", mapping.StaleWhileRevalidate.Duration, now) {
+			p.serveEntry(rw, req, entry, "STALE")
+			p.revalidateInBackground(req, outreq, entry, mapping)
+			return
+		}
+	}
+
+	resp, fetched, shared, err := p.fetchCoalesced(req, outreq, entry, mapping)
+	if err != nil {
+		if entry != nil && staleAllowed(entry, "stale-if-error", mapping.MaxStale.Duration, time.Now()) {
+			p.logf("http: serving stale %v: %v", entry.Key, err)
+			p.serveEntry(rw, req, entry, "STALE")
+			return
+		}
+		p.logf("http: proxy error 1: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if shared {
+		p.serveEntry(rw, req, fetched, "HIT")
+		return
+	}
+	p.serveCacheResult(rw, req, resp, fetched)
+}
+
+// fetchCached requests upstream and caches the response. A server error is
+// returned as error when the stored entry may be served instead.
+func (p *ReverseProxy) fetchCached(req, outreq *http.Request, stored *CacheEntry, mapping *DomainMapping) (*proxyResponse, *CacheEntry, error) {
+	res, err := p.roundTrip(outreq)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored != nil && isServerError(res.StatusCode) &&
+		staleAllowed(stored, "stale-if-error", mapping.MaxStale.Duration, time.Now()) {
+		res.Body.Close()
+		return nil, nil, fmt.Errorf("status %v", res.StatusCode)
+	}
+	resp, entry := p.cacheResponse(req, res, stored, mapping)
+	return resp, entry, nil
+}
+
+// cacheResponse stores the upstream response to the cache, or refreshes
+// the stored entry on 304. It returns the rewritten response, nil on 304,
+// and the entry stored, nil if the response is not cacheable.
+func (p *ReverseProxy) cacheResponse(req *http.Request, res *http.Response, stored *CacheEntry, mapping *DomainMapping) (*proxyResponse, *CacheEntry) {
+	now := time.Now()
+	if res.StatusCode == http.StatusNotModified && stored != nil && !isFollowed(res) {
+		res.Body.Close()
+		entry := stored.revalidated(req, res, mapping, now)
+		p.Cache.Set(entry)
+		return nil, entry
+	}
+
+	entry := newCacheEntry(req, res, mapping, now)
+	var surrogateKeys []string
+	if p.Cache.SurrogateKeyHeader != "" {
+		surrogateKeys = strings.Fields(strings.Join(res.Header[http.CanonicalHeaderKey(p.Cache.SurrogateKeyHeader)], " "))
+		res.Header.Del(p.Cache.SurrogateKeyHeader)
+	}
+
+	resp := p.rewriteResponse(res, mapping)
+	if entry != nil && len(resp.Trailer) == 0 {
+		entry.SurrogateKeys = surrogateKeys
+		entry.Integrity = resp.integrity
+		entry.Header = resp.Header.Clone()
+		entry.Body = resp.Body
+		p.Cache.Set(entry)
+		return resp, entry
+	}
+	return resp, nil
+}
+
+func (p *ReverseProxy) serveCacheResult(rw http.ResponseWriter, req *http.Request, resp *proxyResponse, entry *CacheEntry) {
+	if resp == nil {
+		p.serveEntry(rw, req, entry, "REVALIDATED")
+		return
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	p.writeResponse(rw, req, resp)
+}
+
+// revalidateInBackground refreshes the entry without blocking the client,
+// at most once at a time per entry.
+func (p *ReverseProxy) revalidateInBackground(req, outreq *http.Request, entry *CacheEntry, mapping *DomainMapping) {
+	if _, loaded := p.revalidating.LoadOrStore(entry.Key, true); loaded {
+		return
+	}
+	// the client request is done before we are
+	ctx := context.WithValue(context.Background(), mappingContextKey{}, mapping)
+	outreq = outreq.WithContext(ctx)
+
+	go func() {
+		defer p.revalidating.Delete(entry.Key)
+		res, err := p.roundTrip(outreq)
+		if err != nil {
+			p.logf("http: revalidate %v error: %v", entry.Key, err)
+			return
+		}
+		if isServerError(res.StatusCode) {
+			res.Body.Close()
+			p.logf("http: revalidate %v error: status %v", entry.Key, res.StatusCode)
+			return
+		}
+		p.cacheResponse(req, res, entry, mapping)
+	}()
+}
+
+func (p *ReverseProxy) serveEntry(rw http.ResponseWriter, req *http.Request, entry *CacheEntry, status string) {
+	p.Cache.hit(entry.Key)
+	now := time.Now()
+	resp := &proxyResponse{
+		StatusCode: entry.StatusCode,
+		Header:     entry.Header.Clone(),
+		Body:       entry.Body,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(entry.age(now)/time.Second), 10))
+	resp.Header.Set("X-Cache", status)
+	if !entry.fresh(now) {
+		resp.Header.Set(StaleHeader, strconv.FormatInt(int64(now.Sub(entry.Expires)/time.Second), 10))
+	}
+
+	if resp.StatusCode == http.StatusOK && notModified(req, resp.Header) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = nil
+	}
+	p.writeResponse(rw, req, resp)
+}
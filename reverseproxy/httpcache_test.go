@@ -0,0 +1,94 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy of proxy.test to the upstream, with a cache.
+func newTestProxy(t *testing.T, upstream string, mapping DomainMapping) *ReverseProxy {
+	t.Helper()
+	mapping.From = "proxy.test"
+	mapping.To = upstream
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{mapping}))
+	proxy.Cache = NewCache(1<<20, "")
+	return proxy
+}
+
+func testGet(proxy *ReverseProxy, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://proxy.test"+path, nil)
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	rw := httptest.NewRecorder()
+	proxy.ProxyHTTP(rw, req)
+	return rw
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now()
+	mapping := &DomainMapping{CacheTTL: []TTLOverride{{Path: "/ttl", TTL: Duration{time.Hour}}}}
+	tests := []struct {
+		name     string
+		path     string
+		auth     bool
+		header   http.Header
+		lifetime time.Duration
+		store    bool
+	}{
+		{"max-age", "/", false, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{"s-maxage first", "/", false, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"no-store", "/", false, http.Header{"Cache-Control": {"no-store, max-age=60"}}, 0, false},
+		{"no-cache with validator", "/", false, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"a"`}}, 0, true},
+		{"no lifetime", "/", false, http.Header{}, 0, false},
+		{"ttl override", "/ttl", false, http.Header{"Cache-Control": {"max-age=60"}}, time.Hour, true},
+		{"ttl private", "/ttl", false, http.Header{"Cache-Control": {"private"}}, 0, false},
+		{"ttl no-store", "/ttl", false, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"ttl vary star", "/ttl", false, http.Header{"Vary": {"*"}}, 0, false},
+		{"ttl set-cookie", "/ttl", false, http.Header{"Set-Cookie": {"session=1"}}, 0, false},
+		{"ttl authorization", "/ttl", true, http.Header{}, 0, false},
+		{"ttl authorization public", "/ttl", true, http.Header{"Cache-Control": {"public"}}, time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://proxy.test"+tt.path, nil)
+			if tt.auth {
+				req.Header.Set("Authorization", "Bearer x")
+			}
+			lifetime, store := freshnessLifetime(req, 200, tt.header, mapping, now)
+			if lifetime != tt.lifetime || store != tt.store {
+				t.Errorf("got %v %v, want %v %v", lifetime, store, tt.lifetime, tt.store)
+			}
+		})
+	}
+}
+
+func TestRefusedFreshEntryIsRevalidated(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=600, stale-while-revalidate=600")
+		w.Header().Set("Age", "100")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+
+	if rw := testGet(proxy, "/", nil); rw.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("X-Cache %q", rw.Header().Get("X-Cache"))
+	}
+	if rw := testGet(proxy, "/", nil); rw.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache %q", rw.Header().Get("X-Cache"))
+	}
+	// fresh, but older than the client accepts
+	rw := testGet(proxy, "/", http.Header{"Cache-Control": {"max-age=10"}})
+	if got := rw.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache %q, want MISS", got)
+	}
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Errorf("upstream hits %v, want 2", n)
+	}
+}
@@ -0,0 +1,64 @@
+package reverseproxy
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Hosts of the mappings are kept as lower case A-labels, "xn--bcher-kva.de"
+// for "bücher.de", like the Host header sent by browsers. Bodies may hold
+// either form, the Unicode forms are rewritten too.
+
+// asciiHost returns the A-label form of a host, port included. Hosts which
+// aren't valid domain names, like IPv6 addresses, are only lower cased.
+func asciiHost(host string) string {
+	if isASCII(host) {
+		return strings.ToLower(host)
+	}
+	name, port := splitHostPort(host)
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return strings.ToLower(host)
+	}
+	return joinHostPort(ascii, port)
+}
+
+// unicodeHost returns the Unicode form of a host, port included. Invalid
+// A-labels, which don't convert back to themselves, are kept.
+func unicodeHost(host string) string {
+	name, port := splitHostPort(host)
+	unicode, err := idna.Lookup.ToUnicode(name)
+	if err != nil {
+		return host
+	}
+	if ascii, err := idna.Lookup.ToASCII(unicode); err != nil || ascii != strings.ToLower(name) {
+		return host
+	}
+	return joinHostPort(unicode, port)
+}
+
+func splitHostPort(host string) (string, string) {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return h, port
+	}
+	return host, ""
+}
+
+func joinHostPort(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
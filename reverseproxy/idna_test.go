@@ -0,0 +1,114 @@
+package reverseproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestASCIIHost(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"Bücher.Example:8080", "xn--bcher-kva.example:8080"},
+		{"XN--BCHER-KVA.Example", "xn--bcher-kva.example"},
+		{"Xn--Bcher-Kva.example:443", "xn--bcher-kva.example:443"},
+		{"[::1]:80", "[::1]:80"},
+		{"Twitter.com", "twitter.com"},
+		// not a domain name, only lower cased
+		{"Bü_cher\u0000.example", "bü_cher\u0000.example"},
+	}
+	for _, tt := range tests {
+		if got := asciiHost(tt.in); got != tt.out {
+			t.Errorf("asciiHost(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestUnicodeHost(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"xn--bcher-kva.example:8080", "bücher.example:8080"},
+		{"twitter.com", "twitter.com"},
+		// invalid punycode is kept as is
+		{"xn--.example", "xn--.example"},
+		{"xn--zz-.example", "xn--zz-.example"},
+		{"xn--bcher-kva9999999999.example", "xn--bcher-kva9999999999.example"},
+		{"xn--a-ecp.xn--", "xn--a-ecp.xn--"},
+	}
+	for _, tt := range tests {
+		if got := unicodeHost(tt.in); got != tt.out {
+			t.Errorf("unicodeHost(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestIDNMapping(t *testing.T) {
+	var host string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="http://` + r.Host + `/a">a</a> https://bücher.proxy.test/b`))
+	}))
+	defer upstream.Close()
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{{From: "bücher.proxy.test", To: upstream.URL}}))
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	for _, reqHost := range []string{"xn--bcher-kva.proxy.test", "XN--BCHER-KVA.Proxy.Test", "bücher.proxy.test"} {
+		req := httptest.NewRequest("GET", "http://proxy.test/", nil)
+		req.Host = reqHost
+		rw := httptest.NewRecorder()
+		proxy.ProxyHTTP(rw, req)
+		body, _ := ioutil.ReadAll(rw.Body)
+		if rw.Code != 200 || host != upstreamHost {
+			t.Errorf("%v: got %v from %q", reqHost, rw.Code, host)
+		}
+		// the upstream host is rewritten to the A-label of the proxy
+		if want := `<a href="//xn--bcher-kva.proxy.test/a">a</a>`; !strings.HasPrefix(string(body), want) {
+			t.Errorf("%v: got %q, want %q", reqHost, body, want)
+		}
+	}
+
+	// back to upstream, both forms of the proxy host are replaced
+	got := string(proxy.MapGroup.forward.Replace([]byte("https://bücher.proxy.test/ https://xn--bcher-kva.proxy.test/")))
+	if want := "https://" + upstreamHost + "/ https://" + upstreamHost + "/"; got != want {
+		t.Errorf("forward: got %q, want %q", got, want)
+	}
+}
+
+func TestIDNUnicodeUpstream(t *testing.T) {
+	p := newTestRewriter(DomainMapping{To: "https://Bücher.example"})
+	in := `<a href="https://bücher.example/a"></a><a href="https://xn--bcher-kva.example/b"></a>`
+	want := `<a href="//t.byteio.cn/a"></a><a href="//t.byteio.cn/b"></a>`
+	if got := string(p.rewrite("text/html", []byte(in))); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if p.mapping.To != "xn--bcher-kva.example" {
+		t.Errorf("To = %q", p.mapping.To)
+	}
+}
+
+func TestIDNInvalidHost(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer upstream.Close()
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{{From: "xn--bcher-kva.proxy.test", To: upstream.URL}}))
+	for _, host := range []string{"xn--.proxy.test", "xn--zz-.xn--", "bü\u0000cher.proxy.test", "XN--A-ECP.XN--"} {
+		req := httptest.NewRequest("GET", "http://proxy.test/", nil)
+		req.Host = host
+		proxy.ProxyHTTP(httptest.NewRecorder(), req)
+	}
+	if hits := atomic.LoadInt64(&hits); hits != 0 {
+		t.Errorf("%v invalid hosts proxied", hits)
+	}
+}
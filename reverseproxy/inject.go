@@ -0,0 +1,117 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+)
+
+// Positions of injected HTML.
+const (
+	InjectHeadStart = "head-start"
+	InjectHeadEnd   = "head-end"
+	InjectBodyStart = "body-start"
+	InjectBodyEnd   = "body-end"
+)
+
+// Injection is a snippet of HTML inserted in the HTML pages of a mapping,
+// given inline or read from a file at startup.
+type Injection struct {
+	Position string `json:"position"`
+	HTML     string `json:"html,omitempty"`
+	File     string `json:"file,omitempty"`
+}
+
+func (p *Injection) init() error {
+	switch p.Position {
+	case InjectHeadStart, InjectHeadEnd, InjectBodyStart, InjectBodyEnd:
+	default:
+		return fmt.Errorf("inject: unknown position %q", p.Position)
+	}
+	if p.File != "" {
+		raw, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return fmt.Errorf("inject: %v", err)
+		}
+		p.HTML += string(raw)
+	}
+	return nil
+}
+
+// injection returns the HTML injected at the position, in declared order.
+// In pages of multibyte charsets, the non-ASCII characters of the snippets
+// become character references, see multibyteUnmasker.
+func (p *DomainMapping) injection(position string) []byte {
+	if p == nil {
+		return nil
+	}
+	var out []byte
+	if position == InjectHeadStart && p.ServiceWorker {
+		// first, before any script of the page
+		out = append(out, serviceWorkerTag...)
+	}
+	for _, inject := range p.Inject {
+		if inject.Position == position {
+			out = append(out, inject.HTML...)
+		}
+	}
+	return out
+}
+
+// htmlInjector inserts the injections of a mapping while an HTML document
+// is rewritten. Documents without <head> get the head injections before
+// <body>, fragments without <body> get nothing.
+type htmlInjector struct {
+	mapping *DomainMapping
+	head    bool // <head> seen
+	headEnd bool // head-end written
+	body    bool // <body> seen
+	bodyEnd bool // body-end written
+}
+
+func (p *htmlInjector) startTag(out *bytes.Buffer, name string, raw []byte) {
+	switch {
+	case name == "head" && !p.head && !p.body:
+		p.head = true
+		out.Write(raw)
+		out.Write(p.mapping.injection(InjectHeadStart))
+		return
+	case name == "body" && !p.body:
+		p.body = true
+		if !p.head {
+			p.head = true
+			out.Write(p.mapping.injection(InjectHeadStart))
+		}
+		p.writeHeadEnd(out)
+		out.Write(raw)
+		out.Write(p.mapping.injection(InjectBodyStart))
+		return
+	}
+	out.Write(raw)
+}
+
+func (p *htmlInjector) endTag(out *bytes.Buffer, name string) {
+	switch name {
+	case "head":
+		if p.head {
+			p.writeHeadEnd(out)
+		}
+	case "body":
+		if p.body && !p.bodyEnd {
+			p.bodyEnd = true
+			out.Write(p.mapping.injection(InjectBodyEnd))
+		}
+	}
+}
+
+func (p *htmlInjector) writeHeadEnd(out *bytes.Buffer) {
+	if !p.headEnd {
+		p.headEnd = true
+		out.Write(p.mapping.injection(InjectHeadEnd))
+	}
+}
+
+// end writes the body-end injection of documents without </body>.
+func (p *htmlInjector) end(out *bytes.Buffer) {
+	p.endTag(out, "body")
+}
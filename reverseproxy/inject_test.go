@@ -0,0 +1,94 @@
+package reverseproxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"document",
+			"<html><head><title>t</title></head><body><p>x</p></body></html>",
+			"<html><head>[HS]<title>t</title>[HE]</head><body>[BS]<p>x</p>[BE]</body></html>"},
+		{"upper case tags",
+			"<HTML><HEAD></HEAD><BODY class=a></BODY></HTML>",
+			"<HTML><HEAD>[HS][HE]</HEAD><BODY class=a>[BS][BE]</BODY></HTML>"},
+		{"without head",
+			"<html><body>x</body></html>",
+			"<html>[HS][HE]<body>[BS]x[BE]</body></html>"},
+		{"without </head>",
+			"<head><title>t</title><body>x</body>",
+			"<head>[HS]<title>t</title>[HE]<body>[BS]x[BE]</body>"},
+		{"without </body>",
+			"<html><head></head><body>x",
+			"<html><head>[HS][HE]</head><body>[BS]x[BE]"},
+		{"tags in scripts and comments",
+			"<head><script>'</head>'</script><!-- <body> --></head><body>x</body>",
+			"<head>[HS]<script>'</head>'</script><!-- <body> -->[HE]</head><body>[BS]x[BE]</body>"},
+		{"body end once",
+			"<body>x</body></body>",
+			"[HS][HE]<body>[BS]x[BE]</body></body>"},
+		{"fragment", "<p>x</p>", "<p>x</p>"},
+	}
+	p := newTestRewriter(DomainMapping{Inject: []Injection{
+		{Position: InjectBodyEnd, HTML: "[BE]"},
+		{Position: InjectHeadStart, HTML: "[HS]"},
+		{Position: InjectHeadEnd, HTML: "[HE]"},
+		{Position: InjectBodyStart, HTML: "[BS]"},
+	}})
+	for _, tt := range tests {
+		if got := string(p.rewrite("text/html", []byte(tt.in))); got != tt.out {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.out)
+		}
+	}
+
+	// only HTML documents get injections
+	if got := string(p.rewrite("text/plain", []byte("<body>x</body>"))); got != "<body>x</body>" {
+		t.Errorf("text/plain: got %q", got)
+	}
+}
+
+func TestInjectionOrder(t *testing.T) {
+	p := newTestRewriter(DomainMapping{ServiceWorker: true, Inject: []Injection{
+		{Position: InjectHeadStart, HTML: "[1]"},
+		{Position: InjectHeadStart, HTML: "[2]"},
+	}})
+	got := string(p.rewrite("text/html", []byte("<head></head>")))
+	// the client script comes first, before any script of the page
+	if want := "<head>" + serviceWorkerTag + "[1][2]</head>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInjectionInit(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "snippet.html")
+	if err := ioutil.WriteFile(fp, []byte("<script>file</script>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		inject Injection
+		html   string
+		ok     bool
+	}{
+		{Injection{Position: InjectHeadEnd, HTML: "<i>a</i>"}, "<i>a</i>", true},
+		{Injection{Position: InjectBodyEnd, File: fp}, "<script>file</script>", true},
+		{Injection{Position: InjectBodyEnd, HTML: "<i>a</i>", File: fp}, "<i>a</i><script>file</script>", true},
+		{Injection{Position: InjectBodyEnd, File: fp + ".missing"}, "", false},
+		{Injection{Position: "footer", HTML: "<i>a</i>"}, "", false},
+	}
+	for _, tt := range tests {
+		inject := tt.inject
+		err := inject.init()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: %v", tt.inject, err)
+		}
+		if err == nil && inject.HTML != tt.html {
+			t.Errorf("%+v: html %q, want %q", tt.inject, inject.HTML, tt.html)
+		}
+	}
+}
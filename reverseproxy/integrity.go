@@ -0,0 +1,114 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Policies for the integrity attributes of proxied scripts and stylesheets,
+// whose content no longer matches once rewritten.
+const (
+	// IntegrityStrip removes the attribute
+	IntegrityStrip = "strip"
+	// IntegrityRecompute hashes the rewritten content fresh in the cache,
+	// and strips the attribute of the other resources
+	IntegrityRecompute = "recompute"
+	// IntegrityKeep leaves the attribute alone
+	IntegrityKeep = "keep"
+)
+
+func validateIntegrity(mapping *DomainMapping) error {
+	switch mapping.Integrity {
+	case "":
+		mapping.Integrity = IntegrityStrip
+	case IntegrityStrip, IntegrityRecompute, IntegrityKeep:
+	default:
+		return fmt.Errorf("mapping %v: unknown integrity policy %q", mapping.From, mapping.Integrity)
+	}
+	return nil
+}
+
+var integrityHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// rewriteIntegrity returns the integrity attribute of a script or stylesheet
+// link for the proxied resource, remove tells to drop the attribute.
+func (p *rewriter) rewriteIntegrity(tag *htmlTag, value string) (rewritten string, remove bool) {
+	if p.mapping == nil || p.mapping.Integrity == IntegrityKeep {
+		return value, false
+	}
+	attr := "src"
+	if tag.name == "link" {
+		attr = "href"
+	}
+	resource := strings.TrimSpace(tag.attr(attr))
+	if resource == "" {
+		return value, false
+	}
+	proxied := p.rewriteURL(resource)
+	if proxied == resource && (looksLikeAbsoluteURL(resource) || strings.HasPrefix(resource, "data:")) {
+		// not going through the proxy, its content is untouched
+		return value, false
+	}
+
+	if p.mapping.Integrity == IntegrityRecompute && p.cache != nil {
+		if key := p.resourceCacheKey(proxied); key != "" {
+			if entry := p.cache.Get(key); entry != nil && entry.fresh(time.Now()) {
+				if rv := integrityOf(value, entry.Body); rv != "" {
+					if p.integrity == nil {
+						p.integrity = map[string]time.Time{}
+					}
+					p.integrity[key] = entry.Stored
+					return rv, false
+				}
+			}
+		}
+	}
+	return "", true
+}
+
+func looksLikeAbsoluteURL(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "//")
+}
+
+// resourceCacheKey returns the cache key of a proxied URL, "" if the URL is
+// relative to the page, which the rewriter doesn't know.
+func (p *rewriter) resourceCacheKey(proxied string) string {
+	switch {
+	case strings.HasPrefix(proxied, "//"):
+		return CacheKeyOfURL("http:" + proxied)
+	case strings.HasPrefix(proxied, "/"):
+		return CacheKeyOfURL("http://" + p.mapping.From + proxied)
+	case looksLikeAbsoluteURL(proxied):
+		return CacheKeyOfURL(proxied)
+	}
+	return ""
+}
+
+// integrityOf returns the integrity metadata of the content, with the hash
+// algorithms of the original metadata "sha384-... sha512-...".
+func integrityOf(original string, content []byte) string {
+	var out []string
+	seen := map[string]bool{}
+	for _, token := range strings.Fields(original) {
+		alg := strings.ToLower(strings.SplitN(token, "-", 2)[0])
+		newHash, ok := integrityHashes[alg]
+		if !ok || seen[alg] {
+			continue
+		}
+		seen[alg] = true
+		h := newHash()
+		h.Write(content)
+		out = append(out, alg+"-"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	return strings.Join(out, " ")
+}
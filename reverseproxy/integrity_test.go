@@ -0,0 +1,93 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntegrityOf(t *testing.T) {
+	content := []byte("alert(1)")
+	tests := []struct {
+		original string
+		out      string
+	}{
+		{"sha256-x", "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="},
+		{"sha384-x sha256-y", "sha384-HT2E9NfWiuQ/w1PRai+hTyqW16NIoCGA/m8VQDUopfAtcz6YQjtsMmQd5uRbVDpW sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="},
+		{"SHA256-x sha256-y", "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="},
+		{"md5-x", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := integrityOf(tt.original, content); got != tt.out {
+			t.Errorf("integrityOf(%q) = %q, want %q", tt.original, got, tt.out)
+		}
+	}
+}
+
+func TestRewriteIntegrity(t *testing.T) {
+	cache := NewCache(1<<20, "")
+	now := time.Now()
+	cache.Set(&CacheEntry{Key: "t.byteio.cn/fresh.js", Body: []byte("alert(1)"), Stored: now, Expires: now.Add(time.Hour)})
+	cache.Set(&CacheEntry{Key: "t.byteio.cn/stale.js", Body: []byte("alert(1)"), Stored: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+	hash := "sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI="
+
+	tests := []struct {
+		policy string
+		in     string
+		out    string
+	}{
+		{IntegrityStrip, `<script src="/fresh.js" integrity="sha256-x"></script>`, `<script src="/fresh.js"></script>`},
+		{IntegrityKeep, `<script src="/fresh.js" integrity="sha256-x"></script>`, `<script src="/fresh.js" integrity="sha256-x"></script>`},
+		{IntegrityRecompute, `<script src="/fresh.js" integrity="sha256-x"></script>`, `<script src="/fresh.js" integrity="` + hash + `"></script>`},
+		{IntegrityRecompute, `<script src="https://twitter.com/fresh.js" integrity="sha256-x"></script>`, `<script src="//t.byteio.cn/fresh.js" integrity="` + hash + `"></script>`},
+		{IntegrityRecompute, `<script src="/stale.js" integrity="sha256-x"></script>`, `<script src="/stale.js"></script>`},
+		{IntegrityRecompute, `<script src="/missing.js" integrity="sha256-x"></script>`, `<script src="/missing.js"></script>`},
+		{IntegrityStrip, `<link href="https://example.com/a.css" integrity="sha256-x">`, `<link href="https://example.com/a.css" integrity="sha256-x">`},
+	}
+	for _, tt := range tests {
+		p := newTestRewriter(DomainMapping{Integrity: tt.policy})
+		p.cache = cache
+		if got := string(p.rewriteHTML([]byte(tt.in))); got != tt.out {
+			t.Errorf("%v %v:\ngot  %v\nwant %v", tt.policy, tt.in, got, tt.out)
+		}
+		if tt.policy == IntegrityRecompute && strings.Contains(tt.out, hash) && !p.integrity["t.byteio.cn/fresh.js"].Equal(now) {
+			t.Errorf("%v: hashed entry not recorded: %v", tt.in, p.integrity)
+		}
+	}
+}
+
+func TestIntegrityOutdatedPage(t *testing.T) {
+	var pages int64
+	script := "alert(1)"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		if r.URL.Path == "/a.js" {
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(script))
+			return
+		}
+		atomic.AddInt64(&pages, 1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<script src="/a.js" integrity="sha256-x"></script>`))
+	}))
+	defer upstream.Close()
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{Integrity: IntegrityRecompute})
+
+	testGet(proxy, "/a.js", nil)
+	first := testGet(proxy, "/", nil).Body.String()
+	if rw := testGet(proxy, "/", nil); rw.Header().Get("X-Cache") != "HIT" || rw.Body.String() != first {
+		t.Fatalf("page not served from the cache: %v", rw.Header().Get("X-Cache"))
+	}
+
+	// the script changes, the cached page has an outdated hash
+	script = "alert(2)"
+	testGet(proxy, "/a.js", http.Header{"Cache-Control": {"no-cache"}})
+	rw := testGet(proxy, "/", nil)
+	if rw.Header().Get("X-Cache") != "MISS" || rw.Body.String() == first || atomic.LoadInt64(&pages) != 2 {
+		t.Errorf("outdated page served: %v %v", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+}
@@ -0,0 +1,159 @@
+package reverseproxy
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the Learner, bounding its memory.
+const (
+	MaxLearnedHosts = 10000
+	MaxLearnedPages = 10
+)
+
+// Learner collects the hosts found in the URLs of upstream responses which
+// are not covered by any mapping, to find the mappings missing for a site.
+type Learner struct {
+	mu    sync.Mutex
+	hosts map[string]*LearnedHost
+}
+
+// LearnedHost is an unmapped host seen in upstream responses.
+type LearnedHost struct {
+	Host  string `json:"host"`
+	Hits  int64  `json:"hits"`
+	HTTPS bool   `json:"https"`
+	// Mapping is the from of the mapping where the host was first seen
+	Mapping string `json:"mapping"`
+	// Pages are upstream URLs referring to the host, the first ones seen
+	Pages     []string  `json:"pages"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func NewLearner() *Learner {
+	return &Learner{hosts: map[string]*LearnedHost{}}
+}
+
+// absolute URLs, also JSON escaped, the host is the first group
+var learnedURL = regexp.MustCompile(`(?i)(https?:)?(?:\\?/){2}((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,63})\b`)
+
+// scan records the unmapped hosts of the URLs in the content of a response
+// of the mapping, page is the upstream URL of the response.
+func (p *Learner) scan(group *MapGroup, mapping *DomainMapping, page string, content []byte) {
+	now := time.Now()
+	for _, m := range learnedURL.FindAllSubmatch(content, -1) {
+		host := strings.ToLower(string(m[2]))
+		if found, _ := group.proxyHost(host); found != nil || group.GetMapping(host) != nil {
+			continue
+		}
+		p.observe(host, strings.EqualFold(string(m[1]), "https:"), mapping.From, page, now)
+	}
+}
+
+// scanBody records the unmapped hosts of the URLs in a text body.
+func (p *Learner) scanBody(group *MapGroup, mapping *DomainMapping, page, contentType string, body []byte) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if isTextContent(mediaType) {
+		p.scan(group, mapping, page, body)
+	}
+}
+
+// scanHeader records the unmapped hosts of the URLs in the headers.
+func (p *Learner) scanHeader(group *MapGroup, mapping *DomainMapping, page string, header http.Header) {
+	for _, values := range header {
+		for _, v := range values {
+			p.scan(group, mapping, page, []byte(v))
+		}
+	}
+}
+
+func (p *Learner) observe(host string, https bool, mapping, page string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.hosts[host]
+	if !ok {
+		if len(p.hosts) >= MaxLearnedHosts {
+			return
+		}
+		h = &LearnedHost{Host: host, Mapping: mapping, FirstSeen: now}
+		p.hosts[host] = h
+	}
+	h.Hits++
+	h.HTTPS = h.HTTPS || https
+	h.LastSeen = now
+	if len(h.Pages) < MaxLearnedPages && !contains(h.Pages, page) {
+		h.Pages = append(h.Pages, page)
+	}
+}
+
+// Hosts returns the hosts learned, the most seen first.
+func (p *Learner) Hosts() []LearnedHost {
+	p.mu.Lock()
+	hosts := make([]LearnedHost, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		c := *h
+		c.Pages = append([]string(nil), h.Pages...)
+		hosts = append(hosts, c)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Hits != hosts[j].Hits {
+			return hosts[i].Hits > hosts[j].Hits
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// Reset forgets the hosts learned.
+func (p *Learner) Reset() {
+	p.mu.Lock()
+	p.hosts = map[string]*LearnedHost{}
+	p.mu.Unlock()
+}
+
+// SuggestedMapping is a mapping suggested for a learned host, in the format
+// of the config file.
+type SuggestedMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Suggest returns mappings for the learned hosts seen at least minHits times.
+// The proxy host is the encoded upstream host under the parent domain of the
+// proxy host of the mapping where it was seen: pbs.twimg.com seen on
+// t.example.com gets pbs-twimg-com.example.com.
+func (p *Learner) Suggest(minHits int64) []SuggestedMapping {
+	suggested := []SuggestedMapping{}
+	for _, h := range p.Hosts() {
+		if h.Hits < minHits {
+			continue
+		}
+		scheme := "http"
+		if h.HTTPS {
+			scheme = "https"
+		}
+		suggested = append(suggested, SuggestedMapping{
+			From: encodeHost(h.Host) + "." + parentDomain(h.Mapping),
+			To:   scheme + "://" + h.Host,
+		})
+	}
+	return suggested
+}
+
+// parentDomain drops the first label of a host of three labels or more.
+func parentDomain(host string) string {
+	name, port := splitHostPort(host)
+	if labels := strings.Split(name, "."); len(labels) > 2 {
+		name = strings.Join(labels[1:], ".")
+	}
+	return joinHostPort(name, port)
+}
@@ -0,0 +1,111 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLearnerScan(t *testing.T) {
+	p := newTestRewriter(DomainMapping{})
+	learner := NewLearner()
+	body := `<a href="https://pbs.cdn.test/a"></a><img src="//Pbs.CDN.test/b">` +
+		`"http:\/\/api.cdn.test\/x" https://twitter.com/ https://t.byteio.cn/ //twimg.com/c https://pbs.cdn.test/c`
+	learner.scanBody(p.group, p.mapping, "https://twitter.com/home", "text/html; charset=utf-8", []byte(body))
+	learner.scanBody(p.group, p.mapping, "https://twitter.com/home", "text/html", []byte(`https://pbs.cdn.test/d`))
+	learner.scanBody(p.group, p.mapping, "https://twitter.com/home", "image/png", []byte(`https://png.cdn.test/`))
+	learner.scanHeader(p.group, p.mapping, "https://twitter.com/about", http.Header{"Link": {`<https://api.cdn.test/p>; rel=preload`}})
+
+	hosts := learner.Hosts()
+	type learned struct {
+		Host  string
+		Hits  int64
+		HTTPS bool
+		Pages []string
+	}
+	var got []learned
+	for _, h := range hosts {
+		got = append(got, learned{h.Host, h.Hits, h.HTTPS, h.Pages})
+		if h.Mapping != "t.byteio.cn" || h.FirstSeen.IsZero() || h.LastSeen.Before(h.FirstSeen) {
+			t.Errorf("%v: mapping %q, seen %v %v", h.Host, h.Mapping, h.FirstSeen, h.LastSeen)
+		}
+	}
+	want := []learned{
+		{"pbs.cdn.test", 4, true, []string{"https://twitter.com/home"}},
+		{"api.cdn.test", 2, true, []string{"https://twitter.com/home", "https://twitter.com/about"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	learner.Reset()
+	if hosts := learner.Hosts(); len(hosts) != 0 {
+		t.Errorf("hosts after reset %+v", hosts)
+	}
+}
+
+func TestLearnerLimits(t *testing.T) {
+	learner := NewLearner()
+	now := time.Now()
+	for i := 0; i < MaxLearnedPages+5; i++ {
+		learner.observe("a.cdn.test", false, "t.byteio.cn", fmt.Sprintf("https://twitter.com/%v", i), now)
+	}
+	for i := 0; i < MaxLearnedHosts+5; i++ {
+		learner.observe(fmt.Sprintf("h%v.cdn.test", i), false, "t.byteio.cn", "https://twitter.com/", now)
+	}
+	hosts := learner.Hosts()
+	if len(hosts) != MaxLearnedHosts {
+		t.Errorf("%v hosts learned, want %v", len(hosts), MaxLearnedHosts)
+	}
+	if hosts[0].Host != "a.cdn.test" || len(hosts[0].Pages) != MaxLearnedPages || hosts[0].Hits != MaxLearnedPages+5 {
+		t.Errorf("got %v %v pages %v hits", hosts[0].Host, len(hosts[0].Pages), hosts[0].Hits)
+	}
+}
+
+func TestLearnerSuggest(t *testing.T) {
+	learner := NewLearner()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		learner.observe("pbs.cdn.test", i == 0, "t.example.com", "https://twitter.com/", now)
+	}
+	learner.observe("api.cdn.test", false, "example.com:8080", "https://twitter.com/", now)
+
+	want := []SuggestedMapping{
+		{From: "pbs-cdn-test.example.com", To: "https://pbs.cdn.test"},
+		{From: "api-cdn-test.example.com:8080", To: "http://api.cdn.test"},
+	}
+	if got := learner.Suggest(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := learner.Suggest(2); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("min hits 2: got %+v, want %+v", got, want[:1])
+	}
+}
+
+func TestLearnerProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Link", "<https://fonts.cdn.test/f.woff2>; rel=preload")
+		w.Write([]byte(`<img src="https://pbs.cdn.test/a.png"><a href="http://` + r.Host + `/b">`))
+	}))
+	defer upstream.Close()
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+	proxy.Learner = NewLearner()
+	testGet(proxy, "/page", nil)
+	testGet(proxy, "/page", http.Header{"Cache-Control": {"no-cache"}})
+
+	var got []string
+	for _, h := range proxy.Learner.Hosts() {
+		got = append(got, fmt.Sprintf("%v %v %v", h.Host, h.Hits, h.Pages))
+	}
+	want := []string{
+		fmt.Sprintf("fonts.cdn.test 2 [%v/page]", upstream.URL),
+		fmt.Sprintf("pbs.cdn.test 2 [%v/page]", upstream.URL),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
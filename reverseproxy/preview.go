@@ -0,0 +1,88 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Preview returns the response ProxyHTTP would send to the client for req,
+// when upstream answers with status, header and body, without any request
+// to upstream. The cache is not used.
+func (p *ReverseProxy) Preview(req *http.Request, status int, header http.Header, body []byte) (*http.Response, error) {
+	req.Host = asciiHost(req.Host)
+	mapping := p.MapGroup.GetMapping(req.Host)
+	if mapping == nil {
+		return nil, fmt.Errorf("can't find mapping for %v", req.Host)
+	}
+
+	rw := &previewWriter{header: make(http.Header)}
+	if mapping.ServiceWorker {
+		if resp := p.MapGroup.serviceWorkerResponse(req.URL.Path); resp != nil {
+			p.writeResponse(rw, req, resp)
+			return rw.result(), nil
+		}
+	}
+
+	ctx := context.WithValue(req.Context(), mappingContextKey{}, mapping)
+	outreq := p.outRequest(req.WithContext(ctx), mapping)
+	res := &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    outreq,
+	}
+	p.writeResponse(rw, req, p.rewriteResponse(res, mapping))
+	return rw.result(), nil
+}
+
+// previewWriter keeps the response written to the client by Preview.
+type previewWriter struct {
+	header http.Header
+	sent   http.Header // header when written
+	status int
+	body   bytes.Buffer
+}
+
+func (p *previewWriter) Header() http.Header {
+	return p.header
+}
+
+func (p *previewWriter) WriteHeader(status int) {
+	if p.sent == nil {
+		p.status = status
+		p.sent = p.header.Clone()
+	}
+}
+
+func (p *previewWriter) Write(b []byte) (int, error) {
+	p.WriteHeader(http.StatusOK)
+	return p.body.Write(b)
+}
+
+func (p *previewWriter) result() *http.Response {
+	p.WriteHeader(http.StatusOK)
+	res := &http.Response{
+		StatusCode:    p.status,
+		Status:        fmt.Sprintf("%d %s", p.status, http.StatusText(p.status)),
+		Header:        p.sent,
+		Body:          ioutil.NopCloser(bytes.NewReader(p.body.Bytes())),
+		ContentLength: int64(p.body.Len()),
+	}
+	// the trailers declared, set after the body
+	for _, names := range p.sent["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if vv, ok := p.header[name]; ok {
+				if res.Trailer == nil {
+					res.Trailer = make(http.Header)
+				}
+				res.Trailer[name] = vv
+			}
+		}
+	}
+	return res
+}
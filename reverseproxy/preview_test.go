@@ -0,0 +1,51 @@
+package reverseproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{{From: "t.byteio.cn", To: "https://twitter.com"}})
+	proxy := NewReverseProxy(group)
+
+	req, _ := http.NewRequest("GET", "http://t.byteio.cn/home", nil)
+	header := http.Header{
+		"Content-Type": {"text/html"},
+		"Location":     {"https://twitter.com/login"},
+	}
+	res, err := proxy.Preview(req, http.StatusFound, header, []byte(`<a href="https://twitter.com/x">`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusFound || res.Status != "302 Found" {
+		t.Errorf("status %v %q", res.StatusCode, res.Status)
+	}
+	if location := res.Header.Get("Location"); location != "http://t.byteio.cn/login" {
+		t.Errorf("location %q", location)
+	}
+	if string(body) != `<a href="//t.byteio.cn/x">` || res.ContentLength != int64(len(body)) {
+		t.Errorf("body %q, length %v", body, res.ContentLength)
+	}
+
+	req, _ = http.NewRequest("GET", "http://unmapped.test/", nil)
+	if _, err := proxy.Preview(req, http.StatusOK, http.Header{}, nil); err == nil {
+		t.Error("previewed an unmapped host")
+	}
+}
+
+func TestPreviewBlockedRedirect(t *testing.T) {
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{{From: "t.byteio.cn", To: "https://twitter.com"}}))
+	proxy.UnmappedRedirect = RedirectBlock
+
+	req, _ := http.NewRequest("GET", "http://t.byteio.cn/", nil)
+	res, err := proxy.Preview(req, http.StatusFound, http.Header{"Location": {"https://evil.test/"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode == http.StatusFound || res.Header.Get("Location") != "" {
+		t.Errorf("redirect not blocked: %v %v", res.StatusCode, res.Header)
+	}
+}
@@ -3,7 +3,6 @@
 package reverseproxy
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -12,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -52,6 +52,46 @@ type ReverseProxy struct {
 	ErrorLog *log.Logger
 
 	MapGroup MapGroup
+
+	// Cache stores the rewritten responses, nil disables caching
+	Cache *Cache
+
+	// CoalesceTimeout bounds how long concurrent identical cacheable requests
+	// wait for the single upstream fetch they share, 0 disables coalescing
+	CoalesceTimeout time.Duration
+
+	// Learner collects the unmapped hosts of upstream responses, nil
+	// disables learning
+	Learner *Learner
+
+	// keys of the cache entries being revalidated in background
+	revalidating sync.Map
+
+	flights flightGroup
+
+	// RequestBodyTypes are the media types of the request bodies
+	// whose proxy hosts are replaced by the upstream hosts
+	RequestBodyTypes []string
+
+	// MaxRequestBody is the size limit of the request bodies rewritten,
+	// 0 means DefaultMaxRequestBody
+	MaxRequestBody int64
+
+	// UnmappedRedirect is the policy for redirects to hosts not mapped:
+	// RedirectPass, the default, RedirectBlock or RedirectFollow
+	UnmappedRedirect string
+
+	// MaxRedirects bounds the redirects followed, 0 means DefaultMaxRedirects
+	MaxRedirects int
+}
+
+type mappingContextKey struct{}
+
+// MappingFromContext returns the DomainMapping of the request being proxied,
+// so transports can apply per mapping settings.
+func MappingFromContext(ctx context.Context) *DomainMapping {
+	mapping, _ := ctx.Value(mappingContextKey{}).(*DomainMapping)
+	return mapping
 }
 
 // NewReverseProxy returns a new ReverseProxy that routes
@@ -72,13 +112,26 @@ func NewReverseProxy(mapGroup *MapGroup) *ReverseProxy {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
 	}
-	return &ReverseProxy{Director: DefaultDirector, Transport: transport, MapGroup: *mapGroup}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	follow := followDialer(dialer)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if ctx.Value(followContextKey{}) != nil || ctx.Value(wildcardContextKey{}) != nil {
+			return follow.DialContext(ctx, network, addr)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &ReverseProxy{
+		Director:         DefaultDirector,
+		Transport:        transport,
+		MapGroup:         *mapGroup,
+		RequestBodyTypes: DefaultRequestBodyTypes,
+		MaxRequestBody:   DefaultMaxRequestBody,
+	}
 }
 
 func DefaultDirector(req *http.Request, mapping *DomainMapping) {
@@ -119,14 +172,40 @@ func DefaultDirector(req *http.Request, mapping *DomainMapping) {
 	req.Header.Set("accept-encoding", "gzip")
 }
 
+// proxyResponse is an upstream response after its headers and body
+// have been rewritten, ready to be sent to the client or to be cached.
+type proxyResponse struct {
+	StatusCode int
+	Header     http.Header
+	Trailer    http.Header
+	Body       []byte
+
+	// the cache entries hashed in the body, see CacheEntry
+	integrity map[string]time.Time
+}
+
 func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request) {
 	// get domain mapping
+	req.Host = asciiHost(req.Host)
 	mapping := p.MapGroup.GetMapping(req.Host)
 	if mapping == nil {
 		log.Printf("can't find mapping for %v\n", req.Host)
 		return
 	}
 
+	if mapping.ServiceWorker && strings.HasPrefix(req.URL.Path, ServiceWorkerPrefix) {
+		if resp := p.MapGroup.serviceWorkerResponse(req.URL.Path); resp != nil {
+			p.writeResponse(rw, req, resp)
+			return
+		}
+	}
+
+	// preflights are answered by the CORS policy of the mapping
+	if mapping.CORS != nil && isPreflight(req) {
+		p.writeResponse(rw, req, &proxyResponse{StatusCode: http.StatusNoContent, Header: make(http.Header)})
+		return
+	}
+
 	ctx := req.Context()
 
 	if cn, ok := rw.(http.CloseNotifier); ok {
@@ -143,17 +222,43 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request) {
 		}()
 	}
 
-	// outreq to upstream:
+	ctx = context.WithValue(ctx, mappingContextKey{}, mapping)
+	outreq := p.outRequest(req.WithContext(ctx), mapping)
+
+	if p.Cache != nil {
+		p.proxyCached(rw, req, outreq, mapping)
+		return
+	}
 
-	outreq := req.WithContext(ctx) // includes shallow copies of maps, but okay
+	res, err := p.roundTrip(outreq)
+	if err != nil {
+		p.logf("http: proxy error 1: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	p.writeResponse(rw, req, p.rewriteResponse(res, mapping))
+}
+
+// outRequest builds the request to upstream from the client request.
+func (p *ReverseProxy) outRequest(req *http.Request, mapping *DomainMapping) *http.Request {
+	outreq := new(http.Request)
+	*outreq = *req // includes shallow copies of maps, but okay
 	if req.ContentLength == 0 {
 		outreq.Body = nil // Issue 16036: nil Body for http.Transport retries
 	}
 
+	// keep the client URL and headers untouched, they are still needed after the upstream request
+	u := *req.URL
+	outreq.URL = &u
+	outreq.Header = make(http.Header)
 	copyHeader(outreq.Header, req.Header, nil)
 
 	p.Director(outreq, mapping)
 	outreq.Close = false
+	if mapping.wildcard {
+		outreq = outreq.WithContext(context.WithValue(outreq.Context(), wildcardContextKey{}, true))
+	}
 
 	// Remove hop-by-hop headers listed in the "Connection" header, Remove hop-by-hop headers.
 	removeHeaders(outreq.Header)
@@ -161,75 +266,125 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request) {
 	// replace domain in headers
 	mapping.ReplaceHeader(&outreq.Header)
 
+	mapping.rewriteRequestCookies(outreq.Header)
+	mapping.applyRequestRules(outreq, req.URL.Path)
+	p.rewriteRequestBody(outreq, mapping, req.URL.Path)
+
 	// Add X-Forwarded-For Header.
 	addXForwardedForHeader(outreq)
+	return outreq
+}
 
-	// 2. do request part
-
+func (p *ReverseProxy) roundTrip(outreq *http.Request) (*http.Response, error) {
 	log.Println("requesting...", outreq.Method, outreq.URL)
 	res, err := p.Transport.RoundTrip(outreq)
-	if err != nil {
-		p.logf("http: proxy error 1: %v", err)
-		rw.WriteHeader(http.StatusBadGateway)
-		return
+	if err != nil || p.UnmappedRedirect != RedirectFollow {
+		return res, err
 	}
+	return p.followRedirects(outreq, res)
+}
 
-	// 3. response part
-
+// rewriteResponse rewrites the headers and the body of the upstream response,
+// the body of res is consumed and closed.
+func (p *ReverseProxy) rewriteResponse(res *http.Response, mapping *DomainMapping) *proxyResponse {
 	// Remove hop-by-hop headers listed in the "Connection" header of the response, Remove hop-by-hop headers.
 	removeHeaders(res.Header)
-	// replace domain in headers reversely
+	if p.UnmappedRedirect == RedirectBlock {
+		if target := p.MapGroup.unmappedRedirect(res); target != nil {
+			log.Printf("redirect blocked: %v\n", target)
+			res.Body.Close()
+			return blockedRedirect(target)
+		}
+	}
+
+	page := res.Request.URL.String()
+	if p.Learner != nil {
+		p.Learner.scanHeader(&p.MapGroup, mapping, page, res.Header)
+	}
+
+	// replace domain in headers reversely, but in the headers parsed below
+	parsed := make(http.Header)
+	for _, k := range parsedHeaders {
+		if vv, ok := res.Header[k]; ok {
+			parsed[k] = vv
+			res.Header.Del(k)
+		}
+	}
 	for _, mp := range p.MapGroup.maps {
-		mp.Reverse().ReplaceHeader(&res.Header)
+		if !mp.isWildcard() {
+			mp.Reverse().ReplaceHeader(&res.Header)
+		}
+	}
+	if mapping.wildcard {
+		mapping.Reverse().ReplaceHeader(&res.Header)
+	}
+	p.MapGroup.rewriteSetCookies(parsed, res.Request, mapping)
+	rewriter := p.newRewriter(mapping)
+	rewriter.rewriteLocationHeaders(parsed, res.Request.URL)
+	copyHeader(res.Header, parsed, nil)
+	p.MapGroup.rewriteSecurityHeaders(res.Header, mapping)
+
+	header := make(http.Header)
+	copyHeader(header, res.Header, &[]string{"content-length", "content-encoding"})
+
+	urlPath := mapping.stripBase(res.Request.URL.Path)
+	mapping.applyHeaderRules(RuleScopeResponse, urlPath, header)
+
+	// decompress and rewrite
+	body, contentType := p.rewriteBody(rewriter, page, urlPath, res.Header.Get("Content-Type"), DecompressBody(res))
+	if contentType != res.Header.Get("Content-Type") {
+		header.Set("Content-Type", contentType)
 	}
 
-	// Copy header from response to client.
-	copyHeader(rw.Header(), res.Header, &[]string{"content-length", "content-encoding"})
+	// close now, instead of defer, to populate res.Trailer
+	res.Body.Close()
+
+	return &proxyResponse{
+		StatusCode: res.StatusCode,
+		Header:     header,
+		Trailer:    res.Trailer,
+		Body:       body,
+		integrity:  rewriter.integrity,
+	}
+}
 
-	// add Access-Control-Allow-Origin
-	rw.Header().Set("Access-Control-Allow-Origin", "*")
+func (p *ReverseProxy) writeResponse(rw http.ResponseWriter, req *http.Request, resp *proxyResponse) {
+	// Copy header from response to client.
+	copyHeader(rw.Header(), resp.Header, nil)
+	absoluteLocation(rw.Header(), req)
+	if mapping := p.MapGroup.GetMapping(req.Host); mapping != nil {
+		p.MapGroup.applyCORS(rw.Header(), req, mapping)
+	}
 
 	// The "Trailer" header isn't included in the Transport's response, Build it up from Trailer.
-	if len(res.Trailer) > 0 {
-		trailerKeys := make([]string, 0, len(res.Trailer))
-		for k := range res.Trailer {
+	if len(resp.Trailer) > 0 {
+		trailerKeys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
 			trailerKeys = append(trailerKeys, k)
 		}
 		rw.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
 	}
 
-	rw.WriteHeader(res.StatusCode)
-
-	// gzip part:
-
-	// We are ignoring any q-value here, so this is wrong for the case q=0
-	clientAE := req.Header.Get("Accept-Encoding")
-	clientAcceptsGzip := strings.Contains(clientAE, "gzip")
+	rw.WriteHeader(resp.StatusCode)
 
-	rw.Header().Set("Transfer-Encoding", "chunked")
-	if clientAcceptsGzip {
-		// disable gzip because of gzip bug
-		//rw.Header().Set("Transfer-Encoding", "gzip")
+	written, err := rw.Write(resp.Body)
+	if err != nil || written != len(resp.Body) {
+		if err == nil || err.Error() != "http: request method or response status code does not allow body" {
+			p.logf("write body error: %v, %v/%v", err, len(resp.Body), written)
+		}
 	}
 
-	// decompress and compress
-	r, w, err := HandleCompression(res, rw, clientAcceptsGzip)
-	p.rewriteBody(w, r)
-
 	// trailer part:
 
-	if len(res.Trailer) > 0 {
+	if len(resp.Trailer) > 0 {
 		// Force chunking if we saw a response trailer.
 		// This prevents net/http from calculating the length for short
 		// bodies and adding a Content-Length.
 		if fl, ok := rw.(http.Flusher); ok {
 			fl.Flush()
 		}
+		copyHeader(rw.Header(), resp.Trailer, nil)
 	}
-
-	// close now, instead of defer, to populate res.Trailer
-	res.Body.Close()
-	copyHeader(rw.Header(), res.Trailer, nil)
 }
 
 func (p *ReverseProxy) ProxyHTTPS(rw http.ResponseWriter, req *http.Request) {
@@ -300,15 +455,22 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (p *ReverseProxy) rewriteBody(dst io.Writer, src io.Reader) {
+// rewriteBody returns the rewritten body, and its Content-Type which changes
+// when the body is converted to UTF-8. page is the upstream URL.
+func (p *ReverseProxy) rewriteBody(rewriter *rewriter, page, urlPath, contentType string, src io.Reader) ([]byte, string) {
+	mapping := rewriter.mapping
 	bodyData, err := ioutil.ReadAll(src)
 
 	if err == nil {
 		if len(bodyData) > 0 {
-			for _, mapping := range p.MapGroup.maps {
-				bodyData = mapping.Reverse().ReplaceBytes(bodyData)
+			var encode func([]byte) []byte
+			bodyData, encode, contentType, rewriter.multibyte = decodeBody(contentType, bodyData)
+			if p.Learner != nil {
+				p.Learner.scanBody(&p.MapGroup, mapping, page, contentType, bodyData)
 			}
-			bodyData = bytes.Replace(bodyData, []byte("https://"), []byte("//"), -1)
+			bodyData = rewriter.rewrite(contentType, bodyData)
+			bodyData = mapping.applyBodyRules(RuleScopeResponse, urlPath, contentType, bodyData, rewriter.multibyte)
+			bodyData = encode(bodyData)
 		}
 	} else {
 		log.Printf("read body error: %v\n", err)
@@ -316,15 +478,7 @@ func (p *ReverseProxy) rewriteBody(dst io.Writer, src io.Reader) {
 		// https://github.com/golang/go/issues/10069
 		bodyData = make([]byte, 0)
 	}
-	//fmt.Println(string(bodyData[0:50]))
-
-	written, err := dst.Write(bodyData)
-	if err != nil || written != len(bodyData) || len(bodyData) == 0 {
-		if err != nil && err.Error() == "http: request method or response status code does not allow body" {
-			return
-		}
-		p.logf("rewrite body error: %v, %v/%v", err, len(bodyData), written)
-	}
+	return bodyData, contentType
 }
 
 func (p *ReverseProxy) logf(format string, args ...interface{}) {
@@ -0,0 +1,229 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRecordHeaders are the request headers which take part in the
+// recording key when RecordTransport.Headers is empty.
+var DefaultRecordHeaders = []string{"Accept", "Accept-Language"}
+
+// RecordTransport is a http.RoundTripper which stores every upstream
+// response into Dir, or in replay mode serves the stored responses
+// without touching the network at all.
+type RecordTransport struct {
+	// Dir is the directory holding the recordings
+	Dir string
+
+	// Replay serves recordings instead of calling Transport
+	Replay bool
+
+	// Headers are the request headers used to build the recording key
+	Headers []string
+
+	// Transport is used to reach the upstream in record mode
+	Transport http.RoundTripper
+}
+
+type recording struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Trailer    http.Header `json:"trailer,omitempty"`
+	Body       []byte      `json:"body"`
+	Recorded   time.Time   `json:"recorded"`
+}
+
+func NewRecordTransport(dir string, replay bool, transport http.RoundTripper) *RecordTransport {
+	if !replay {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("create record dir error: %v\n", err)
+		}
+	}
+	return &RecordTransport{Dir: dir, Replay: replay, Transport: transport}
+}
+
+func (p *RecordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := p.key(req)
+	if err != nil {
+		return nil, err
+	}
+	fp := filepath.Join(p.Dir, key+".json")
+
+	if p.Replay {
+		rec, err := readRecording(fp)
+		if err != nil {
+			return nil, fmt.Errorf("no recording for %v %v: %v", req.Method, req.URL, err)
+		}
+		if DEBUG {
+			log.Printf("replay %v %v from %v\n", req.Method, req.URL, fp)
+		}
+		return rec.response(req), nil
+	}
+
+	res, err := p.Transport.RoundTrip(req)
+	if err != nil || isServerError(res.StatusCode) {
+		if rec := p.fallback(req, fp); rec != nil {
+			if err == nil {
+				res.Body.Close()
+				err = fmt.Errorf("status %v", res.StatusCode)
+			}
+			log.Printf("serving recording of %v %v: %v\n", req.Method, req.URL, err)
+			return rec.response(req), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// a server error doesn't replace the recording kept for the fallback
+	if _, err := os.Stat(fp); err == nil && isServerError(res.StatusCode) {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return res, nil
+	}
+
+	rec := &recording{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Trailer:    res.Trailer,
+		Body:       body,
+		Recorded:   time.Now(),
+	}
+	if err := writeRecording(fp, rec); err != nil {
+		log.Printf("write recording error: %v\n", err)
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// key identifies a request by method, URL, selected headers and body hash.
+// The headers are taken in sorted order, so the key doesn't depend on how
+// they are listed. The request body is read and restored.
+func (p *RecordTransport) key(req *http.Request) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v %v\n", req.Method, req.URL.String())
+
+	headers := p.Headers
+	if len(headers) == 0 {
+		headers = DefaultRecordHeaders
+	}
+	names := make([]string, 0, len(headers))
+	for _, k := range headers {
+		names = append(names, http.CanonicalHeaderKey(strings.TrimSpace(k)))
+	}
+	sort.Strings(names)
+	for i, k := range names {
+		if i > 0 && k == names[i-1] {
+			continue
+		}
+		fmt.Fprintf(h, "%v: %v\n", k, req.Header.Get(k))
+	}
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		h.Write(sum[:])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fallback returns the previous recording to serve when upstream fails,
+// as long as it is not older than the max_stale of the mapping.
+func (p *RecordTransport) fallback(req *http.Request, fp string) *recording {
+	rec, err := readRecording(fp)
+	if err != nil {
+		return nil
+	}
+	if rec.Recorded.IsZero() {
+		if fi, err := os.Stat(fp); err == nil {
+			rec.Recorded = fi.ModTime()
+		}
+	}
+	mapping := MappingFromContext(req.Context())
+	if mapping != nil && mapping.MaxStale.Duration > 0 && time.Since(rec.Recorded) > mapping.MaxStale.Duration {
+		return nil
+	}
+	rec.Header = rec.Header.Clone()
+	rec.Header.Set(StaleHeader, strconv.FormatInt(int64(time.Since(rec.Recorded)/time.Second), 10))
+	return rec
+}
+
+func (p *recording) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", p.StatusCode, http.StatusText(p.StatusCode)),
+		StatusCode:    p.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        p.Header.Clone(),
+		Trailer:       p.Trailer.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(p.Body)),
+		ContentLength: int64(len(p.Body)),
+		Request:       req,
+	}
+}
+
+func readRecording(fp string) (*recording, error) {
+	raw, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recording{}
+	if err := json.Unmarshal(raw, rec); err != nil {
+		return nil, err
+	}
+	if rec.Header == nil {
+		rec.Header = http.Header{}
+	}
+	return rec, nil
+}
+
+func writeRecording(fp string, rec *recording) error {
+	raw, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename, so a concurrent replay never reads a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(fp), ".recording-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
@@ -0,0 +1,167 @@
+package reverseproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordKey(t *testing.T) {
+	newReq := func(method, url, body string, header http.Header) *http.Request {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header = header
+		return req
+	}
+	base := newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}})
+	tests := []struct {
+		name    string
+		headers []string
+		req     *http.Request
+		same    bool
+	}{
+		{"same request", nil,
+			newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept-Language": {"en"}, "Accept": {"text/html"}}), true},
+		{"headers listed in other order", []string{"accept-language", " Accept"},
+			newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}}), true},
+		{"header listed twice", []string{"Accept", "Accept-Language", "accept"},
+			newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}}), true},
+		{"other headers ignored", nil,
+			newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}, "Cookie": {"a=1"}}), true},
+		{"other body", nil,
+			newReq("POST", "https://example.net/a", "x=2", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}}), false},
+		{"other header value", nil,
+			newReq("POST", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"fr"}}), false},
+		{"other method", nil,
+			newReq("PUT", "https://example.net/a", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}}), false},
+		{"other query", nil,
+			newReq("POST", "https://example.net/a?b", "x=1", http.Header{"Accept": {"text/html"}, "Accept-Language": {"en"}}), false},
+	}
+	want, err := (&RecordTransport{}).key(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got, err := (&RecordTransport{Headers: tt.headers}).key(tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == want) != tt.same {
+			t.Errorf("%v: same key %v, want %v", tt.name, got == want, tt.same)
+		}
+		// the body is still there to be sent
+		if body, _ := ioutil.ReadAll(tt.req.Body); len(body) != 3 {
+			t.Errorf("%v: body %q after key", tt.name, body)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		w.Write([]byte("page " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	dir := filepath.Join(t.TempDir(), "records")
+
+	record := NewRecordTransport(dir, false, http.DefaultTransport)
+	res, err := record.RoundTrip(httptest.NewRequest("GET", upstream.URL+"/a", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "page /a" {
+		t.Errorf("record got %q", body)
+	}
+
+	replay := NewRecordTransport(dir, true, nil)
+	res, err = replay.RoundTrip(httptest.NewRequest("GET", upstream.URL+"/a", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "page /a" || res.Header.Get("X-Upstream") != "1" {
+		t.Errorf("replay got %v %q %v", res.StatusCode, body, res.Header)
+	}
+	if _, err := replay.RoundTrip(httptest.NewRequest("GET", upstream.URL+"/b", nil)); err == nil {
+		t.Error("replay of a request not recorded")
+	}
+}
+
+func TestRecordFallback(t *testing.T) {
+	var failing int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("recorded"))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	transport := NewRecordTransport(dir, false, http.DefaultTransport)
+	get := func(mapping *DomainMapping) *http.Response {
+		req := httptest.NewRequest("GET", upstream.URL+"/", nil)
+		if mapping != nil {
+			req = req.WithContext(context.WithValue(req.Context(), mappingContextKey{}, mapping))
+		}
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	get(nil)
+	atomic.StoreInt32(&failing, 1)
+
+	// rewrites the time of the recording
+	setRecorded := func(recorded time.Time) {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		if len(files) != 1 {
+			t.Fatalf("recordings %v", files)
+		}
+		rec, err := readRecording(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Recorded = recorded
+		if err := writeRecording(files[0], rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRecorded(time.Now().Add(-30 * time.Minute))
+
+	tests := []struct {
+		name     string
+		mapping  *DomainMapping
+		fallback bool
+	}{
+		{"within max_stale", &DomainMapping{MaxStale: Duration{time.Hour}}, true},
+		{"over max_stale", &DomainMapping{MaxStale: Duration{10 * time.Minute}}, false},
+		{"no max_stale", &DomainMapping{}, true},
+		{"no mapping", nil, true},
+	}
+	for _, tt := range tests {
+		res := get(tt.mapping)
+		body, _ := ioutil.ReadAll(res.Body)
+		if tt.fallback {
+			if res.StatusCode != 200 || string(body) != "recorded" || res.Header.Get(StaleHeader) == "" {
+				t.Errorf("%v: got %v %q %v", tt.name, res.StatusCode, body, res.Header)
+			}
+		} else if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("%v: got %v, want the upstream error", tt.name, res.StatusCode)
+		}
+	}
+
+	// the failed responses don't replace the recording
+	setRecorded(time.Now())
+	res := get(&DomainMapping{MaxStale: Duration{time.Minute}})
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "recorded" {
+		t.Errorf("recording replaced by %q", body)
+	}
+}
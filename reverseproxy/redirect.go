@@ -0,0 +1,254 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// Policies for the redirects of upstream to hosts not mapped.
+const (
+	// RedirectPass sends the redirect to the client, who leaves the proxy
+	RedirectPass = "pass"
+	// RedirectBlock answers a page linking to the target instead
+	RedirectBlock = "block"
+	// RedirectFollow follows the redirect on the proxy side
+	RedirectFollow = "follow"
+)
+
+// DefaultMaxRedirects is the number of redirects followed by RedirectFollow.
+const DefaultMaxRedirects = 5
+
+// followContextKey marks the requests of followed redirects, which only
+// reach public addresses.
+type followContextKey struct{}
+
+// addresses which are not public, RFC 6890
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isPublicIP(ip net.IP) bool {
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// isFollowed tells if the response is the one of a followed redirect.
+func isFollowed(res *http.Response) bool {
+	return res.Request != nil && res.Request.Context().Value(followContextKey{}) != nil
+}
+
+// followDialer dials the public addresses only, checked once resolved so
+// the names resolving to internal addresses are refused too. It dials the
+// followed redirects and the hosts of wildcard mappings.
+func followDialer(dialer *net.Dialer) *net.Dialer {
+	follow := *dialer
+	follow.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return fmt.Errorf("non public address %v refused", host)
+		}
+		return nil
+	}
+	return &follow
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// unmappedRedirect returns the target of a redirect to a host not mapped.
+func (p *MapGroup) unmappedRedirect(res *http.Response) *url.URL {
+	if !isRedirect(res.StatusCode) {
+		return nil
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	target, err := res.Request.URL.Parse(location)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil
+	}
+	if mapping, _ := p.proxyHost(target.Host); mapping != nil {
+		return nil
+	}
+	return target
+}
+
+// followRedirects follows the redirects of upstream to hosts not mapped,
+// up to MaxRedirects, like a client would.
+func (p *ReverseProxy) followRedirects(req *http.Request, res *http.Response) (*http.Response, error) {
+	max := p.MaxRedirects
+	if max <= 0 {
+		max = DefaultMaxRedirects
+	}
+	for hops := 0; ; hops++ {
+		target := p.MapGroup.unmappedRedirect(res)
+		if target == nil {
+			return res, nil
+		}
+		if ip := net.ParseIP(strings.Trim(target.Hostname(), "[]")); ip != nil && !isPublicIP(ip) {
+			log.Printf("redirect to non public address refused: %v\n", target)
+			return res, nil
+		}
+		if hops >= max {
+			log.Printf("too many redirects: %v\n", target)
+			return res, nil
+		}
+		next, err := redirectRequest(req, res.StatusCode, target)
+		if err != nil {
+			log.Printf("can't follow redirect to %v: %v\n", target, err)
+			return res, nil
+		}
+		res.Body.Close()
+
+		log.Println("following redirect...", next.Method, next.URL)
+		res, err = p.Transport.RoundTrip(next)
+		if err != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// redirectRequest returns the request following the redirect of req.
+func redirectRequest(req *http.Request, status int, target *url.URL) (*http.Request, error) {
+	next := req.Clone(context.WithValue(req.Context(), followContextKey{}, true))
+	next.URL = target
+	next.Host = target.Host
+	next.RequestURI = ""
+
+	if status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect {
+		// same method and body
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("request body can't be sent again")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			next.Body = body
+		}
+	} else {
+		if req.Method != http.MethodHead {
+			next.Method = http.MethodGet
+		}
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+
+	// credentials are for the original host only
+	if !strings.EqualFold(target.Host, req.URL.Host) {
+		next.Header.Del("Cookie")
+		next.Header.Del("Authorization")
+	}
+	return next, nil
+}
+
+// blockedRedirect answers a page linking to the target of a blocked redirect.
+func blockedRedirect(target *url.URL) *proxyResponse {
+	u := html.EscapeString(target.String())
+	body := "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Redirect blocked</title></head>\n" +
+		"<body><h1>Redirect blocked</h1><p>The site redirects to <a href=\"" + u + "\" rel=\"noreferrer\">" + u +
+		"</a>, which is not proxied.</p></body></html>\n"
+	header := make(http.Header)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	return &proxyResponse{
+		StatusCode: http.StatusForbidden,
+		Header:     header,
+		Body:       []byte(body),
+	}
+}
+
+// rewriteLocationHeaders rewrites the URLs of the Location, Content-Location,
+// Refresh and Link headers. Mapped URLs become protocol relative, and get the
+// scheme of the client in writeResponse, others are made absolute.
+func (p *rewriter) rewriteLocationHeaders(header http.Header, base *url.URL) {
+	for _, k := range []string{"Location", "Content-Location"} {
+		if v := header.Get(k); v != "" {
+			header.Set(k, p.rewriteLocation(v, base))
+		}
+	}
+	if v := header.Get("Refresh"); v != "" {
+		header.Set("Refresh", p.rewriteRefresh(v))
+	}
+	for i, v := range header["Link"] {
+		header["Link"][i] = p.rewriteLink(v)
+	}
+}
+
+func (p *rewriter) rewriteLocation(location string, base *url.URL) string {
+	target, err := base.Parse(location)
+	if err != nil {
+		return location
+	}
+	return p.rewriteURL(target.String())
+}
+
+// rewriteLink rewrites the URLs of `<https://example.com/a.css>; rel=preload, <...>`.
+func (p *rewriter) rewriteLink(value string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start
+		out.WriteString(value[:start+1])
+		out.WriteString(p.rewriteURL(value[start+1 : end]))
+		value = value[end:]
+	}
+	out.WriteString(value)
+	return out.String()
+}
+
+// absoluteLocation gives the scheme of the client to a protocol relative
+// Location, cached responses are shared by http and https clients.
+func absoluteLocation(header http.Header, req *http.Request) {
+	if v := header.Get("Location"); strings.HasPrefix(v, "//") {
+		header.Set("Location", clientScheme(req)+":"+v)
+	}
+}
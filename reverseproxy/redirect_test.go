@@ -0,0 +1,123 @@
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%v) = %v", tt.ip, got)
+		}
+	}
+}
+
+func TestUnmappedRedirect(t *testing.T) {
+	group := newTestRewriter(DomainMapping{}).group
+	tests := []struct {
+		status   int
+		location string
+		target   string
+	}{
+		{302, "https://example.com/a", "https://example.com/a"},
+		{301, "https://api.twitter.com/a", ""},
+		{302, "/relative", ""},
+		{302, "ftp://example.com/", ""},
+		{200, "https://example.com/", ""},
+		{307, "//example.com/a", "https://example.com/a"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://twitter.com/", nil)
+		res := &http.Response{StatusCode: tt.status, Header: http.Header{"Location": {tt.location}}, Request: req}
+		target := group.unmappedRedirect(res)
+		if (target == nil && tt.target != "") || (target != nil && target.String() != tt.target) {
+			t.Errorf("%v %v: got %v", tt.status, tt.location, target)
+		}
+	}
+}
+
+func TestRedirectRequest(t *testing.T) {
+	target, _ := url.Parse("https://example.com/b")
+	req := httptest.NewRequest("POST", "https://twitter.com/a", nil)
+	req.Header.Set("Cookie", "a=1")
+	req.Header.Set("Content-Type", "text/plain")
+
+	next, err := redirectRequest(req, http.StatusFound, target)
+	if err != nil || next.Method != "GET" || next.Header.Get("Cookie") != "" || next.Header.Get("Content-Type") != "" || next.Host != "example.com" {
+		t.Errorf("302: %v %v %v", err, next.Method, next.Header)
+	}
+	if next.Context().Value(followContextKey{}) == nil {
+		t.Error("followed request not marked")
+	}
+	next, err = redirectRequest(req, http.StatusTemporaryRedirect, target)
+	if err != nil || next.Method != "POST" || next.Header.Get("Content-Type") == "" {
+		t.Errorf("307: %v %v %v", err, next.Method, next.Header)
+	}
+}
+
+func TestFollowRefusesInternalAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("internal server reached")
+	}))
+	defer internal.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/secret", http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxy(t, upstream.URL, DomainMapping{})
+	proxy.UnmappedRedirect = RedirectFollow
+	rw := testGet(proxy, "/", nil)
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != internal.URL+"/secret" {
+		t.Errorf("got %v %v", rw.Code, rw.Header().Get("Location"))
+	}
+
+	// names resolving to internal addresses are refused when dialed
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+	req := httptest.NewRequest("GET", "http://localhost:"+port+"/secret", nil)
+	req = req.WithContext(context.WithValue(req.Context(), followContextKey{}, true))
+	req.RequestURI = ""
+	if res, err := proxy.Transport.RoundTrip(req); err == nil {
+		res.Body.Close()
+		t.Error("followed request reached localhost")
+	}
+}
+
+func TestFollowedResponseNotCached(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://proxy.test/", nil)
+	followed := req.WithContext(context.WithValue(req.Context(), followContextKey{}, true))
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	if newCacheEntry(req, &http.Response{StatusCode: 200, Header: header, Request: req}, &DomainMapping{}, time.Now()) == nil {
+		t.Error("response not cached")
+	}
+	if newCacheEntry(req, &http.Response{StatusCode: 200, Header: header, Request: followed}, &DomainMapping{}, time.Now()) != nil {
+		t.Error("followed response cached")
+	}
+}
@@ -12,12 +12,104 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 type DomainMapping struct {
 	From   string   `json:"from"`
 	To     string   `json:"to"`
 	Target *url.URL `json:"-"`
+
+	// wildcard tells the mapping was made for a host by a wildcard mapping
+	wildcard bool
+
+	// CacheTTL overrides the freshness lifetime for matching paths,
+	// for upstreams with bad caching headers
+	CacheTTL []TTLOverride `json:"cache_ttl,omitempty"`
+
+	// MaxStale is how long after expiry a cached or recorded response is still
+	// served when upstream fails, overriding stale-if-error from upstream
+	MaxStale Duration `json:"max_stale,omitempty"`
+
+	// StaleWhileRevalidate is how long after expiry a cached response is served
+	// while being revalidated in background, overriding stale-while-revalidate
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate,omitempty"`
+
+	// RewriteText also replaces the upstream hosts in the visible text of
+	// HTML pages, by default only URLs are rewritten
+	RewriteText bool `json:"rewrite_text,omitempty"`
+
+	// Escapes enables rewriting of escaped forms of the upstream URLs
+	// in bodies: "json", "percent" and "unicode"
+	Escapes []string `json:"escapes,omitempty"`
+
+	// Rules are find/replace rules applied in declared order
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Inject inserts HTML snippets in the HTML pages
+	Inject []Injection `json:"inject,omitempty"`
+
+	// Cookies tells how the cookies are rewritten
+	Cookies CookieConfig `json:"cookies,omitempty"`
+
+	// Security tells how the security headers are handled
+	Security SecurityConfig `json:"security,omitempty"`
+
+	// CORS is the CORS policy answered by the proxy, nil keeps the
+	// policy of upstream
+	CORS *CORSConfig `json:"cors,omitempty"`
+
+	// ServiceWorker injects the scripts mapping the URLs built by the pages
+	// in the browser, see ServiceWorkerPrefix
+	ServiceWorker bool `json:"service_worker,omitempty"`
+
+	// Allow and Deny are the upstream domains reachable through a wildcard
+	// mapping, their subdomains included, see isWildcard
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// CertFile and KeyFile are the PEM certificate, with its chain, and key
+	// served for the mapping in HTTPS mode. KeyFile defaults to CertFile.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// Integrity is the policy for the integrity attributes of proxied
+	// scripts and stylesheets: "strip", the default, "recompute" or "keep"
+	Integrity string `json:"integrity,omitempty"`
+}
+
+type TTLOverride struct {
+	Path string   `json:"path"`
+	TTL  Duration `json:"ttl"`
+}
+
+// Duration is a time.Duration read from JSON as "1h30m" or as seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (p *Duration) UnmarshalJSON(raw []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		p.Duration = time.Duration(value * float64(time.Second))
+	case string:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		p.Duration = d
+	default:
+		return fmt.Errorf("invalid duration %v", string(raw))
+	}
+	return nil
+}
+
+func (p Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
 }
 
 func (p *DomainMapping) Reverse() *DomainMapping {
@@ -50,10 +142,15 @@ func (p *DomainMapping) ReplaceHeader(head *http.Header) {
 
 type MapGroup struct {
 	maps []DomainMapping
+
+	// replacer of the upstream hosts in bodies, built by init
+	replacer *replacer
+	// forward replacer of the proxy hosts in request bodies
+	forward *replacer
 }
 
 func NewMapGroup(maps []DomainMapping) *MapGroup {
-	rv := &MapGroup{maps}
+	rv := &MapGroup{maps: maps}
 	rv.init()
 	return rv
 }
@@ -72,7 +169,7 @@ func LoadMapGroupFromJson(fp string) *MapGroup {
 		os.Exit(1)
 	}
 
-	rv := &MapGroup{mpArr}
+	rv := &MapGroup{maps: mpArr}
 	rv.init()
 	return rv
 }
@@ -83,43 +180,99 @@ func (p *MapGroup) init() {
 		if err != nil {
 			panic(err)
 		}
+		url.Host = asciiHost(url.Host)
 		p.maps[i].Target = url
 		p.maps[i].To = url.Host
+		p.maps[i].From = asciiHost(mapping.From)
+		if err := validateWildcard(&p.maps[i]); err != nil {
+			panic(err)
+		}
+		if err := validateEscapes(&p.maps[i]); err != nil {
+			panic(err)
+		}
+		if err := validateIntegrity(&p.maps[i]); err != nil {
+			panic(err)
+		}
+		for k := range p.maps[i].Rules {
+			if err := p.maps[i].Rules[k].init(); err != nil {
+				panic(fmt.Errorf("mapping %v: %v", mapping.From, err))
+			}
+		}
+		if err := p.maps[i].Cookies.init(); err != nil {
+			panic(fmt.Errorf("mapping %v: %v", mapping.From, err))
+		}
+		if err := p.maps[i].Security.init(); err != nil {
+			panic(fmt.Errorf("mapping %v: %v", mapping.From, err))
+		}
+		for k := range p.maps[i].Inject {
+			if err := p.maps[i].Inject[k].init(); err != nil {
+				panic(fmt.Errorf("mapping %v: %v", mapping.From, err))
+			}
+		}
 	}
-}
 
-func (p *MapGroup) GetMapping(host string) *DomainMapping {
+	replacements := []replacement{}
+	for i := range p.maps {
+		if !p.maps[i].isWildcard() {
+			replacements = append(replacements, escapedReplacements(&p.maps[i])...)
+		}
+	}
 	for _, mapping := range p.maps {
-		if strings.HasSuffix(host, mapping.From) {
-			return &mapping
+		if mapping.isWildcard() {
+			continue
+		}
+		rev := mapping.Reverse()
+		replacements = append(replacements, replacement{[]byte(rev.From), []byte(rev.To)})
+		if to := unicodeHost(mapping.To); to != mapping.To {
+			replacements = append(replacements, replacement{[]byte(to), []byte(mapping.From)})
 		}
 	}
-	return nil
+	replacements = append(replacements, replacement{[]byte("https://"), []byte("//")})
+	p.replacer = newReplacer(replacements)
+
+	forward := []replacement{}
+	for _, mapping := range p.maps {
+		if mapping.isWildcard() {
+			continue
+		}
+		forward = append(forward, replacement{[]byte(mapping.From), []byte(mapping.To)})
+		if from := unicodeHost(mapping.From); from != mapping.From {
+			forward = append(forward, replacement{[]byte(from), []byte(mapping.To)})
+		}
+	}
+	p.forward = newReplacer(forward)
 }
 
-type BodyDecompressor struct {
-	requestIn  *http.Request        // client request
-	responseIn *http.Response       // server response
-	writerOut  *http.ResponseWriter // proxy response
+// Mappings returns a copy of the mappings.
+func (p *MapGroup) Mappings() []DomainMapping {
+	return append([]DomainMapping(nil), p.maps...)
 }
 
-func HandleCompression(in *http.Response, out http.ResponseWriter, clientAcceptGzip bool) (reader io.Reader, writer io.Writer, err error) {
-	reader = in.Body
-	writer = out
+func (p *MapGroup) GetMapping(host string) *DomainMapping {
+	host = asciiHost(host)
+	for i, mapping := range p.maps {
+		if mapping.isWildcard() {
+			if strings.HasSuffix(host, mapping.From[1:]) {
+				return p.proxyWildcard(&p.maps[i], host)
+			}
+		} else if strings.HasSuffix(host, mapping.From) {
+			return &mapping
+		}
+	}
+	return nil
+}
 
+// DecompressBody returns a reader of the decoded body of the upstream response.
+// We always ask upstream for gzip, and never compress for the client
+// because of a bug: net/http always writes header "Content-Length: 10".
+func DecompressBody(in *http.Response) io.Reader {
 	if in.Header.Get("Content-Encoding") == "gzip" {
-		rd, e := gzip.NewReader(in.Body)
-		if e != nil {
-			log.Println(e)
+		rd, err := gzip.NewReader(in.Body)
+		if err != nil {
+			log.Println(err)
 		} else {
-			reader = rd
+			return rd
 		}
 	}
-
-	if clientAcceptGzip {
-		// Have bug: always write header "Content-Length: 10"
-		//writer = gzip.NewWriter(writer)
-	}
-
-	return
+	return in.Body
 }
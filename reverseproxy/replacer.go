@@ -0,0 +1,121 @@
+package reverseproxy
+
+import "bytes"
+
+// replacer replaces many patterns in a single scan, using an Aho-Corasick
+// automaton. At each position the leftmost match wins, then the longest one,
+// and replaced text is never matched again.
+type replacer struct {
+	patterns []replacement
+	// next is the transition table, 256 entries per state
+	next []int32
+	// out is the longest pattern ending at a state, -1 if none
+	out []int32
+	// depth is the length of the prefix of a state
+	depth []int32
+}
+
+func newReplacer(patterns []replacement) *replacer {
+	p := &replacer{}
+	p.addState(0)
+
+	for _, r := range patterns {
+		if len(r.old) == 0 {
+			continue
+		}
+		state := int32(0)
+		for _, c := range r.old {
+			k := int(state)<<8 | int(c)
+			if p.next[k] == 0 {
+				p.next[k] = p.addState(p.depth[state] + 1)
+			}
+			state = p.next[k]
+		}
+		// the first of duplicated patterns wins
+		if p.out[state] < 0 {
+			p.out[state] = int32(len(p.patterns))
+			p.patterns = append(p.patterns, r)
+		}
+	}
+
+	// breadth first, fill the failure transitions
+	fail := make([]int32, len(p.out))
+	queue := []int32{}
+	for c := 0; c < 256; c++ {
+		if s := p.next[c]; s != 0 {
+			queue = append(queue, s)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		if p.out[state] < 0 {
+			p.out[state] = p.out[fail[state]]
+		}
+		for c := 0; c < 256; c++ {
+			k := int(state)<<8 | c
+			if s := p.next[k]; s != 0 {
+				fail[s] = p.next[int(fail[state])<<8|c]
+				queue = append(queue, s)
+			} else {
+				p.next[k] = p.next[int(fail[state])<<8|c]
+			}
+		}
+	}
+	return p
+}
+
+func (p *replacer) addState(depth int32) int32 {
+	p.next = append(p.next, make([]int32, 256)...)
+	p.out = append(p.out, -1)
+	p.depth = append(p.depth, depth)
+	return int32(len(p.out) - 1)
+}
+
+// Replace returns the content with all the patterns replaced.
+func (p *replacer) Replace(content []byte) []byte {
+	if p == nil || len(p.patterns) == 0 {
+		return content
+	}
+
+	var out *bytes.Buffer
+	last := 0
+	n := len(content)
+	for i := 0; i < n; {
+		// the pending match, the leftmost then longest seen so far
+		start, matched := -1, int32(-1)
+		state := int32(0)
+		j := i
+		for ; j < n; j++ {
+			state = p.next[int(state)<<8|int(content[j])]
+			// no match can start at or before the pending one anymore
+			if matched >= 0 && j-int(p.depth[state])+1 > start {
+				break
+			}
+			if m := p.out[state]; m >= 0 {
+				s := j - len(p.patterns[m].old) + 1
+				if matched < 0 || s < start || (s == start && len(p.patterns[m].old) > len(p.patterns[matched].old)) {
+					start, matched = s, m
+				}
+			}
+		}
+		if matched < 0 {
+			break
+		}
+
+		if out == nil {
+			out = bytes.NewBuffer(make([]byte, 0, n+n/8))
+		}
+		r := p.patterns[matched]
+		out.Write(content[last:start])
+		out.Write(r.new)
+		last = start + len(r.old)
+		i = last
+	}
+
+	if out == nil {
+		return content
+	}
+	out.Write(content[last:])
+	return out.Bytes()
+}
@@ -0,0 +1,102 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func newTestReplacer(pairs ...string) *replacer {
+	var patterns []replacement
+	for i := 0; i+1 < len(pairs); i += 2 {
+		patterns = append(patterns, replacement{[]byte(pairs[i]), []byte(pairs[i+1])})
+	}
+	return newReplacer(patterns)
+}
+
+func TestReplacer(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+		in    string
+		out   string
+	}{
+		{"none", []string{"a", "b"}, "xyz", "xyz"},
+		{"all", []string{"a", "b"}, "aXaa", "bXbb"},
+		{"longest", []string{"twitter.com", "t.cn", "twitter.com.hk", "t.hk"},
+			"twitter.com.hk twitter.com", "t.hk t.cn"},
+		{"leftmost before longest", []string{"bcd", "1", "ab", "2"}, "abcd", "2cd"},
+		{"leftmost of overlapping", []string{"abc", "1", "bcdef", "2"}, "abcdef", "1def"},
+		{"longer pattern failing", []string{"abcd", "1", "b", "2"}, "abce", "a2ce"},
+		{"replaced text not matched again", []string{"a.com", "b.com", "b.com", "c.com"},
+			"a.com b.com", "b.com c.com"},
+		{"replacement containing the pattern", []string{"x", "xx"}, "xax", "xxaxx"},
+		{"first duplicate wins", []string{"a", "1", "a", "2"}, "a", "1"},
+		{"empty pattern ignored", []string{"", "1", "a", "2"}, "ba", "b2"},
+		{"prefix of another", []string{"twimg.com", "img", "pbs.twimg.com", "pbs"},
+			"pbs.twimg.com twimg.com", "pbs img"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(newTestReplacer(tt.pairs...).Replace([]byte(tt.in))); got != tt.out {
+				t.Errorf("got %q, want %q", got, tt.out)
+			}
+		})
+	}
+
+	var empty *replacer
+	if got := string(empty.Replace([]byte("a"))); got != "a" {
+		t.Errorf("nil replacer: %q", got)
+	}
+}
+
+// benchmarkPatterns returns the host replacements of n mappings, and a 1MB
+// HTML body linking to them.
+func benchmarkPatterns(n int) ([]replacement, []byte) {
+	var patterns []replacement
+	for i := 0; i < n; i++ {
+		patterns = append(patterns, replacement{
+			[]byte(fmt.Sprintf("upstream%d.example.com", i)),
+			[]byte(fmt.Sprintf("proxy%d.byteio.cn", i)),
+		})
+	}
+	var body bytes.Buffer
+	for i := 0; body.Len() < 1<<20; i++ {
+		fmt.Fprintf(&body, `<div class="item"><a href="https://upstream%d.example.com/path/%d">item %d</a> some text</div>`+"\n", i%n, i, i)
+	}
+	return patterns, body.Bytes()
+}
+
+// the replacement loop replaced by the replacer
+func replaceLoop(patterns []replacement, body []byte) []byte {
+	for _, r := range patterns {
+		body = bytes.Replace(body, r.old, r.new, -1)
+	}
+	return body
+}
+
+func TestReplacerMatchesLoop(t *testing.T) {
+	patterns, body := benchmarkPatterns(40)
+	if !bytes.Equal(newReplacer(patterns).Replace(body), replaceLoop(patterns, body)) {
+		t.Error("replacer and loop differ on distinct hosts")
+	}
+}
+
+func BenchmarkReplaceLoop(b *testing.B) {
+	patterns, body := benchmarkPatterns(40)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replaceLoop(patterns, body)
+	}
+}
+
+func BenchmarkReplacer(b *testing.B) {
+	patterns, body := benchmarkPatterns(40)
+	r := newReplacer(patterns)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Replace(body)
+	}
+}
@@ -0,0 +1,173 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultRequestBodyTypes are the media types of the request bodies whose
+// proxy hosts are replaced by the upstream hosts.
+var DefaultRequestBodyTypes = []string{
+	"application/x-www-form-urlencoded",
+	"application/json",
+	"multipart/form-data",
+}
+
+// DefaultMaxRequestBody is the size limit of the request bodies rewritten.
+const DefaultMaxRequestBody = 1 << 20
+
+// rewriteRequestBody replaces the proxy hosts by the upstream hosts in the body
+// of the request to upstream, then applies the request body rules of the
+// mapping. Bodies over MaxRequestBody are sent untouched.
+func (p *ReverseProxy) rewriteRequestBody(outreq *http.Request, mapping *DomainMapping, urlPath string) {
+	if outreq.Body == nil {
+		return
+	}
+	contentType := outreq.Header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	rewriteHosts := false
+	for _, t := range p.RequestBodyTypes {
+		if strings.EqualFold(t, mediaType) {
+			rewriteHosts = true
+		}
+	}
+	if !rewriteHosts && len(mapping.rules(RuleScopeRequest, RuleTargetBody, urlPath)) == 0 {
+		return
+	}
+
+	limit := p.MaxRequestBody
+	if limit <= 0 {
+		limit = DefaultMaxRequestBody
+	}
+	if outreq.ContentLength > limit {
+		log.Printf("request body too large to rewrite: %v\n", outreq.ContentLength)
+		return
+	}
+
+	body := outreq.Body
+	raw, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(raw)) > limit {
+		if err != nil {
+			log.Printf("read request body error: %v\n", err)
+		} else {
+			log.Printf("request body too large to rewrite\n")
+		}
+		// send the body untouched, what was read then the rest
+		outreq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), body), body}
+		return
+	}
+	body.Close()
+
+	if rewriteHosts {
+		raw = p.MapGroup.rewriteRequestHosts(mediaType, params, raw)
+	}
+	raw = mapping.applyBodyRules(RuleScopeRequest, urlPath, contentType, raw, false)
+
+	outreq.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	outreq.ContentLength = int64(len(raw))
+	if outreq.Header.Get("Content-Length") != "" {
+		outreq.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+	}
+	outreq.TransferEncoding = nil
+	outreq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(raw)), nil
+	}
+}
+
+// rewriteRequestHosts replaces the proxy hosts by the upstream hosts in a
+// request body of the media type.
+func (p *MapGroup) rewriteRequestHosts(mediaType string, params map[string]string, raw []byte) []byte {
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return p.rewriteForm(raw)
+	case "multipart/form-data":
+		rv, err := p.rewriteMultipart(params["boundary"], raw)
+		if err != nil {
+			log.Printf("rewrite multipart body error: %v\n", err)
+			return raw
+		}
+		return rv
+	}
+	return p.forward.Replace(raw)
+}
+
+// rewriteForm rewrites the decoded keys and values of an urlencoded form,
+// the pairs left alone keep their encoding.
+func (p *MapGroup) rewriteForm(raw []byte) []byte {
+	pairs := strings.Split(string(raw), "&")
+	for i, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		changed := false
+		for k, part := range parts {
+			decoded, err := url.QueryUnescape(part)
+			if err != nil {
+				continue
+			}
+			if rewritten := string(p.forward.Replace([]byte(decoded))); rewritten != decoded {
+				parts[k] = url.QueryEscape(rewritten)
+				changed = true
+			}
+		}
+		if changed {
+			pairs[i] = strings.Join(parts, "=")
+		}
+	}
+	return []byte(strings.Join(pairs, "&"))
+}
+
+// rewriteMultipart rewrites the text parts of a multipart form, files are
+// kept as is. The boundary is kept, so the Content-Type stays valid.
+func (p *MapGroup) rewriteMultipart(boundary string, raw []byte) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(raw), boundary)
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" && isTextPart(part.Header.Get("Content-Type")) {
+			content = p.forward.Replace(content)
+		}
+		w, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(content)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func isTextPart(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "application/x-www-form-urlencoded"
+}
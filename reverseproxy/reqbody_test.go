@@ -0,0 +1,88 @@
+package reverseproxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRequestBody(t *testing.T) {
+	multipart := "--XB\r\n" +
+		"Content-Disposition: form-data; name=\"url\"\r\n\r\n" +
+		"https://t.byteio.cn/a\r\n" +
+		"--XB\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"https://t.byteio.cn/a\r\n" +
+		"--XB--\r\n"
+	large := `{"u":"https://t.byteio.cn/` + strings.Repeat("a", 300) + `"}`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		chunked     bool // the length is unknown
+		want        string
+	}{
+		{"urlencoded", "application/x-www-form-urlencoded",
+			"u=https%3A%2F%2Ft.byteio.cn%2Fa&k=v%20x",
+			false, "u=https%3A%2F%2Ftwitter.com%2Fa&k=v%20x"},
+		{"urlencoded key", "application/x-www-form-urlencoded",
+			"t.byteio.cn=1", false, "twitter.com=1"},
+		{"json", "application/json; charset=utf-8",
+			`{"u":"https://t.byteio.cn/a","i":"//img.byteio.cn/b"}`,
+			false, `{"u":"https://twitter.com/a","i":"//twimg.com/b"}`},
+		{"multipart", "multipart/form-data; boundary=XB", multipart,
+			false, strings.Replace(multipart, "t.byteio.cn", "twitter.com", 1)},
+		{"other type", "text/plain", "https://t.byteio.cn/a", false, "https://t.byteio.cn/a"},
+		{"request rule", "text/plain", "token=secret", false, "token=hidden"},
+		{"rule and hosts", "application/json", `{"u":"https://t.byteio.cn/secret"}`,
+			false, `{"u":"https://twitter.com/hidden"}`},
+		{"over limit", "application/json", large, false, large},
+		{"over limit chunked", "application/json", large, true, large},
+		{"chunked", "application/json", `"https://t.byteio.cn/"`, true, `"https://twitter.com/"`},
+	}
+	rewriter := newTestRewriter(DomainMapping{Rules: []Rule{
+		{Find: "secret", Replace: "hidden", Scope: RuleScopeRequest},
+		{Find: "https", Replace: "http"},
+	}})
+	proxy := &ReverseProxy{MapGroup: *rewriter.group, RequestBodyTypes: DefaultRequestBodyTypes, MaxRequestBody: 256}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outreq := httptest.NewRequest("POST", "https://twitter.com/api", strings.NewReader(tt.body))
+			outreq.Header.Set("Content-Type", tt.contentType)
+			if tt.chunked {
+				outreq.ContentLength = -1
+				outreq.Body = ioutil.NopCloser(outreq.Body)
+			} else {
+				outreq.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			}
+			proxy.rewriteRequestBody(outreq, rewriter.mapping, "/api")
+
+			got, err := ioutil.ReadAll(outreq.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			length := int64(len(tt.want))
+			if tt.chunked && tt.want == tt.body {
+				length = -1
+			}
+			if outreq.ContentLength != length {
+				t.Errorf("ContentLength %v, want %v", outreq.ContentLength, length)
+			}
+			if !tt.chunked && outreq.Header.Get("Content-Length") != strconv.Itoa(len(tt.want)) {
+				t.Errorf("Content-Length %v, want %v", outreq.Header.Get("Content-Length"), len(tt.want))
+			}
+			if outreq.ContentLength >= 0 && outreq.GetBody != nil {
+				body, _ := outreq.GetBody()
+				if again, _ := ioutil.ReadAll(body); string(again) != tt.want {
+					t.Errorf("GetBody %q, want %q", again, tt.want)
+				}
+			}
+		})
+	}
+}
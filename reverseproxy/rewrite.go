@@ -0,0 +1,144 @@
+package reverseproxy
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// rewriter rewrites the content of a response for the mapping of the request.
+type rewriter struct {
+	group   *MapGroup
+	mapping *DomainMapping
+	cache   *Cache
+
+	// the cache entries hashed in integrity attributes, see CacheEntry
+	integrity map[string]time.Time
+	// multibyte tells the body is in a multibyte charset, see decodeBody
+	multibyte bool
+}
+
+func (p *ReverseProxy) newRewriter(mapping *DomainMapping) *rewriter {
+	return &rewriter{group: &p.MapGroup, mapping: mapping, cache: p.Cache}
+}
+
+// rewrite dispatches the body to the rewriter of its content type.
+func (p *rewriter) rewrite(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return p.rewriteHTML(body)
+	case "text/css":
+		return p.rewriteCSS(body)
+	}
+	return p.replace(body)
+}
+
+// replace is the blind replacement of every upstream host by its proxy
+// host, with https:// turned into protocol relative //, and of the escaped
+// forms enabled by the mappings, in a single pass. The URLs of the hosts
+// proxied by wildcard mappings are rewritten after.
+func (p *rewriter) replace(body []byte) []byte {
+	return p.group.replaceWildcardHosts(p.group.replacer.Replace(body))
+}
+
+// proxyHost returns the mapping whose upstream covers the host, subdomains
+// included, and the host on the proxy side.
+func (p *MapGroup) proxyHost(host string) (*DomainMapping, string) {
+	host = asciiHost(host)
+	var found *DomainMapping
+	proxyHost := ""
+	for i := range p.maps {
+		mapping := &p.maps[i]
+		if mapping.isWildcard() {
+			continue
+		}
+		to := strings.ToLower(mapping.To)
+		if host != to && !strings.HasSuffix(host, "."+to) {
+			continue
+		}
+		if found == nil || len(to) > len(found.To) {
+			found = mapping
+			proxyHost = host[:len(host)-len(to)] + mapping.From
+		}
+	}
+	if found == nil {
+		return p.upstreamWildcard(host)
+	}
+	return found, proxyHost
+}
+
+// stripBase removes the path of the mapping target from an upstream path,
+// DefaultDirector adds it back.
+func (p *DomainMapping) stripBase(urlPath string) string {
+	if p.Target == nil {
+		return urlPath
+	}
+	base := strings.TrimSuffix(p.Target.Path, "/")
+	if base == "" || !strings.HasPrefix(urlPath, base) {
+		return urlPath
+	}
+	rest := urlPath[len(base):]
+	switch {
+	case rest == "":
+		return "/"
+	case rest[0] == '?' || rest[0] == '#':
+		return "/" + rest
+	case rest[0] == '/':
+		return rest
+	}
+	return urlPath
+}
+
+// rewriteURL turns an upstream URL into the URL on the proxy. Absolute URLs
+// of mapped hosts become protocol relative, without the default port of
+// their scheme, root relative URLs lose the base path of the target,
+// anything else is left alone.
+func (p *rewriter) rewriteURL(raw string) string {
+	s := strings.TrimSpace(raw)
+	lower := strings.ToLower(s)
+
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(s, "//") {
+		rest := s[strings.Index(s, "//")+2:]
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		// only the authority is parsed, the rest is kept as written
+		u, err := url.Parse("http://" + rest[:end])
+		if err != nil {
+			return raw
+		}
+		authority := u.Host
+		if port := u.Port(); (port == "80" && strings.HasPrefix(lower, "http:")) ||
+			(port == "443" && strings.HasPrefix(lower, "https:")) {
+			authority = strings.TrimSuffix(u.Host, ":"+port)
+		}
+		mapping, host := p.group.proxyHost(authority)
+		if mapping == nil && authority != u.Host {
+			mapping, host = p.group.proxyHost(u.Host)
+		}
+		if mapping == nil {
+			return raw
+		}
+		if u.User != nil {
+			host = u.User.String() + "@" + host
+		}
+		return "//" + host + mapping.stripBase(rest[end:])
+	}
+
+	if strings.HasPrefix(s, "/") && p.mapping != nil {
+		if stripped := p.mapping.stripBase(s); stripped != s {
+			return stripped
+		}
+	}
+	return raw
+}
+
+// looksLikeURL tells if an attribute value of unknown meaning is an URL.
+func looksLikeURL(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") ||
+		strings.HasPrefix(s, "//") || (strings.HasPrefix(s, "/") && !strings.ContainsAny(s, " \t\n"))
+}
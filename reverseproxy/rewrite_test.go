@@ -0,0 +1,44 @@
+package reverseproxy
+
+import (
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"https://twitter.com/a?b#c", "//t.byteio.cn/a?b#c"},
+		{"HTTPS://Twitter.COM/a", "//t.byteio.cn/a"},
+		{"//twitter.com", "//t.byteio.cn"},
+		{"https://api.twitter.com/a", "//api.t.byteio.cn/a"},
+		// the default port is dropped, others are kept
+		{"https://twitter.com:443/x", "//t.byteio.cn/x"},
+		{"http://twitter.com:80/x", "//t.byteio.cn/x"},
+		{"http://twitter.com:443/x", "http://twitter.com:443/x"},
+		{"https://twitter.com:8443/x", "https://twitter.com:8443/x"},
+		{"https://local.test:8443/x", "//l.byteio.cn/x"},
+		// user info
+		{"https://u@twitter.com/x", "//u@t.byteio.cn/x"},
+		{"https://u:p@twitter.com:443/x", "//u:p@t.byteio.cn/x"},
+		// look alike hosts
+		{"https://twitter.com.evil.test/x", "https://twitter.com.evil.test/x"},
+		{"https://eviltwitter.com/x", "https://eviltwitter.com/x"},
+		{"https://evil.test/twitter.com", "https://evil.test/twitter.com"},
+		{"https://twitter.com@evil.test/x", "https://twitter.com@evil.test/x"},
+		{"https://[::1", "https://[::1"},
+		{"/a", "/a"},
+		{"a/b", "a/b"},
+	}
+	group := NewMapGroup([]DomainMapping{
+		{From: "t.byteio.cn", To: "https://twitter.com"},
+		{From: "l.byteio.cn", To: "https://local.test:8443"},
+	})
+	p := &rewriter{group: group, mapping: &group.maps[0]}
+	for _, tt := range tests {
+		if got := p.rewriteURL(tt.in); got != tt.out {
+			t.Errorf("rewriteURL(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
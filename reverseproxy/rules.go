@@ -0,0 +1,168 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rule scopes and targets.
+const (
+	RuleScopeRequest  = "request"
+	RuleScopeResponse = "response"
+	RuleTargetBody    = "body"
+	RuleTargetHeader  = "header"
+)
+
+// Rule is a find/replace of a mapping, for what the host replacement can't fix.
+// Response rules see the content after the hosts are rewritten, request rules
+// see the request about to be sent upstream.
+type Rule struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+
+	// Regex makes Find a regular expression, Replace can refer to its
+	// capture groups as $1 or ${name}
+	Regex bool `json:"regex,omitempty"`
+
+	// Scope is "response", the default, or "request"
+	Scope string `json:"scope,omitempty"`
+	// Target is "body", the default, or "header"
+	Target string `json:"target,omitempty"`
+
+	// Headers limits a header rule to these headers, all of them by default
+	Headers []string `json:"headers,omitempty"`
+	// ContentTypes limits a body rule to these media types, like "text/*"
+	ContentTypes []string `json:"content_types,omitempty"`
+	// Paths limits the rule to these request path patterns, like "/api/*"
+	Paths []string `json:"paths,omitempty"`
+
+	re *regexp.Regexp
+	// ascii tells the rule only has ASCII text, others are not applied to
+	// the bodies in multibyte charsets, see decodeBody
+	ascii bool
+}
+
+func (p *Rule) init() error {
+	if p.Find == "" {
+		return fmt.Errorf("rule without find")
+	}
+	switch p.Scope {
+	case "":
+		p.Scope = RuleScopeResponse
+	case RuleScopeRequest, RuleScopeResponse:
+	default:
+		return fmt.Errorf("rule %q: unknown scope %q", p.Find, p.Scope)
+	}
+	switch p.Target {
+	case "":
+		p.Target = RuleTargetBody
+	case RuleTargetBody, RuleTargetHeader:
+	default:
+		return fmt.Errorf("rule %q: unknown target %q", p.Find, p.Target)
+	}
+	if p.Regex {
+		re, err := regexp.Compile(p.Find)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", p.Find, err)
+		}
+		p.re = re
+	}
+	p.ascii = isASCII(p.Find) && isASCII(p.Replace)
+	if !p.ascii && p.Target == RuleTargetBody {
+		log.Printf("rule %q: non-ASCII, not applied to bodies in Shift_JIS, GBK, Big5 or EUC charsets\n", p.Find)
+	}
+	return nil
+}
+
+func (p *Rule) matchPath(urlPath string) bool {
+	if len(p.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range p.Paths {
+		if matchPath(pattern, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Rule) matchContentType(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, pattern := range p.ContentTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Rule) matchHeader(name string) bool {
+	if len(p.Headers) == 0 {
+		return true
+	}
+	for _, h := range p.Headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Rule) apply(content []byte) []byte {
+	if p.re != nil {
+		return p.re.ReplaceAll(content, []byte(p.Replace))
+	}
+	return bytes.Replace(content, []byte(p.Find), []byte(p.Replace), -1)
+}
+
+// rules returns the rules of the scope and target matching the request path.
+func (p *DomainMapping) rules(scope, target, urlPath string) []*Rule {
+	var rv []*Rule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Scope == scope && rule.Target == target && rule.matchPath(urlPath) {
+			rv = append(rv, rule)
+		}
+	}
+	return rv
+}
+
+// applyBodyRules applies the body rules in declared order. The bodies of
+// multibyte charsets only get the ASCII rules.
+func (p *DomainMapping) applyBodyRules(scope, urlPath, contentType string, body []byte, multibyte bool) []byte {
+	for _, rule := range p.rules(scope, RuleTargetBody, urlPath) {
+		if rule.matchContentType(contentType) && (rule.ascii || !multibyte) {
+			body = rule.apply(body)
+		}
+	}
+	return body
+}
+
+// applyHeaderRules applies the header rules in declared order.
+func (p *DomainMapping) applyHeaderRules(scope, urlPath string, header http.Header) {
+	for _, rule := range p.rules(scope, RuleTargetHeader, urlPath) {
+		for k, vv := range header {
+			if !rule.matchHeader(k) {
+				continue
+			}
+			for i, v := range vv {
+				vv[i] = string(rule.apply([]byte(v)))
+			}
+		}
+	}
+}
+
+// applyRequestRules applies the request header rules to the request to
+// upstream, urlPath is the path requested by the client.
+func (p *DomainMapping) applyRequestRules(outreq *http.Request, urlPath string) {
+	p.applyHeaderRules(RuleScopeRequest, urlPath, outreq.Header)
+}
@@ -0,0 +1,95 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplyBodyRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       []Rule
+		path        string
+		contentType string
+		in          string
+		out         string
+	}{
+		{"literal", []Rule{{Find: "a.b", Replace: "x"}}, "/", "text/html", "a.b axb", "x axb"},
+		{"regex", []Rule{{Find: "a.b", Replace: "x", Regex: true}}, "/", "text/html", "a.b axb", "x x"},
+		{"regex groups", []Rule{{Find: `(?P<k>\w+)=(\d+)`, Replace: "${k}:$2", Regex: true}}, "/", "text/plain", "a=1 b=2", "a:1 b:2"},
+		{"literal dollar", []Rule{{Find: "price", Replace: "$1"}}, "/", "text/plain", "price", "$1"},
+		{"declared order", []Rule{{Find: "a", Replace: "b"}, {Find: "b", Replace: "c"}}, "/", "text/plain", "ab", "cc"},
+		{"reverse order", []Rule{{Find: "b", Replace: "c"}, {Find: "a", Replace: "b"}}, "/", "text/plain", "ab", "bc"},
+		{"path match", []Rule{{Find: "a", Replace: "b", Paths: []string{"/api/*"}}}, "/api/v1", "text/plain", "a", "b"},
+		{"path no match", []Rule{{Find: "a", Replace: "b", Paths: []string{"/api/*"}}}, "/home", "text/plain", "a", "a"},
+		{"path exact", []Rule{{Find: "a", Replace: "b", Paths: []string{"/x", "/y"}}}, "/y", "text/plain", "a", "b"},
+		{"type match", []Rule{{Find: "a", Replace: "b", ContentTypes: []string{"text/html"}}}, "/", "text/html; charset=utf-8", "a", "b"},
+		{"type wildcard", []Rule{{Find: "a", Replace: "b", ContentTypes: []string{"Text/*"}}}, "/", "text/css", "a", "b"},
+		{"type no match", []Rule{{Find: "a", Replace: "b", ContentTypes: []string{"text/*"}}}, "/", "application/json", "a", "a"},
+		{"request scope", []Rule{{Find: "a", Replace: "b", Scope: RuleScopeRequest}}, "/", "text/plain", "a", "a"},
+		{"header target", []Rule{{Find: "a", Replace: "b", Target: RuleTargetHeader}}, "/", "text/plain", "a", "a"},
+	}
+	for _, tt := range tests {
+		group := NewMapGroup([]DomainMapping{{From: "proxy.test", To: "https://example.net", Rules: tt.rules}})
+		mapping := &group.maps[0]
+		got := mapping.applyBodyRules(RuleScopeResponse, tt.path, tt.contentType, []byte(tt.in), false)
+		if string(got) != tt.out {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.out)
+		}
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{{From: "proxy.test", To: "https://example.net", Rules: []Rule{
+		{Find: "example.net", Replace: "proxy.test", Target: RuleTargetHeader, Headers: []string{"x-origin"}},
+		{Find: `v(\d)`, Replace: "version $1", Regex: true, Target: RuleTargetHeader, Paths: []string{"/api/*"}},
+		{Find: "token", Replace: "-", Target: RuleTargetHeader, Scope: RuleScopeRequest},
+	}}})
+	mapping := &group.maps[0]
+	tests := []struct {
+		path   string
+		header http.Header
+		want   http.Header
+	}{
+		{"/", http.Header{"X-Origin": {"example.net"}, "Link": {"example.net"}},
+			http.Header{"X-Origin": {"proxy.test"}, "Link": {"example.net"}}},
+		{"/api/a", http.Header{"X-Api": {"v1", "v2"}, "X-Token": {"token"}},
+			http.Header{"X-Api": {"version 1", "version 2"}, "X-Token": {"token"}}},
+		{"/", http.Header{"X-Api": {"v1"}}, http.Header{"X-Api": {"v1"}}},
+	}
+	for _, tt := range tests {
+		mapping.applyHeaderRules(RuleScopeResponse, tt.path, tt.header)
+		for k, vv := range tt.want {
+			for i, v := range vv {
+				if got := tt.header[k][i]; got != v {
+					t.Errorf("%v %v: got %q, want %q", tt.path, k, got, v)
+				}
+			}
+		}
+	}
+}
+
+func TestRuleInit(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{Find: "a"}, true},
+		{Rule{Find: "a", Scope: RuleScopeRequest, Target: RuleTargetHeader}, true},
+		{Rule{Find: "(a", Regex: true}, false},
+		{Rule{Find: "(a"}, true},
+		{Rule{Find: ""}, false},
+		{Rule{Find: "a", Scope: "both"}, false},
+		{Rule{Find: "a", Target: "cookie"}, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		err := rule.init()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: %v", tt.rule, err)
+		}
+		if err == nil && (rule.Scope == "" || rule.Target == "") {
+			t.Errorf("%+v: no default scope or target", tt.rule)
+		}
+	}
+}
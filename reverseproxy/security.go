@@ -0,0 +1,323 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSP policies.
+const (
+	CSPRewrite = "rewrite"
+	CSPRelax   = "relax"
+	CSPDrop    = "drop"
+)
+
+// response headers parsed and rewritten, instead of the host replacement
+var parsedHeaders = []string{
+	"Set-Cookie",
+	"Location", "Content-Location", "Refresh", "Link",
+	"Content-Security-Policy", "Content-Security-Policy-Report-Only",
+}
+
+// HeaderDrop removes a security header, see SecurityConfig.
+const HeaderDrop = "drop"
+
+// SecurityConfig tells how the security headers of a mapping are handled.
+// For HSTS, FrameOptions and PermissionsPolicy, empty keeps the upstream
+// header, "drop" removes it, any other value replaces it.
+type SecurityConfig struct {
+	// CSP is "rewrite", the default, to map the host sources of the
+	// Content-Security-Policy, "relax" to also allow inline scripts and styles
+	// and drop reporting and trusted types, or "drop" to remove it
+	CSP string `json:"csp,omitempty"`
+
+	HSTS              string `json:"hsts,omitempty"`
+	FrameOptions      string `json:"frame_options,omitempty"`
+	PermissionsPolicy string `json:"permissions_policy,omitempty"`
+}
+
+func (p *SecurityConfig) init() error {
+	switch p.CSP {
+	case "":
+		p.CSP = CSPRewrite
+	case CSPRewrite, CSPRelax, CSPDrop:
+	default:
+		return fmt.Errorf("security: unknown csp policy %q", p.CSP)
+	}
+	return nil
+}
+
+// CORSConfig is the CORS policy of a mapping, answered by the proxy.
+type CORSConfig struct {
+	// Origins allowed: "*" for any origin, "mapped" for the proxy hosts,
+	// or origins like "https://app.example.com"
+	Origins []string `json:"origins"`
+
+	Credentials bool `json:"credentials,omitempty"`
+
+	// Methods and Headers allowed by preflights, those requested by default
+	Methods []string `json:"methods,omitempty"`
+	Headers []string `json:"headers,omitempty"`
+
+	ExposeHeaders []string `json:"expose_headers,omitempty"`
+	MaxAge        Duration `json:"max_age,omitempty"`
+}
+
+// rewriteSecurityHeaders applies the security config of the mapping to the
+// headers of an upstream response.
+func (p *MapGroup) rewriteSecurityHeaders(header http.Header, mapping *DomainMapping) {
+	config := &mapping.Security
+	for _, k := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		values := header[k]
+		if len(values) == 0 {
+			continue
+		}
+		if config.CSP == CSPDrop {
+			header.Del(k)
+			continue
+		}
+		for i, v := range values {
+			values[i] = p.rewriteCSP(v, config.CSP == CSPRelax)
+		}
+	}
+
+	for k, value := range map[string]string{
+		"Strict-Transport-Security": config.HSTS,
+		"X-Frame-Options":           config.FrameOptions,
+		"Permissions-Policy":        config.PermissionsPolicy,
+	} {
+		switch value {
+		case "":
+		case HeaderDrop:
+			header.Del(k)
+		default:
+			header.Set(k, value)
+		}
+	}
+}
+
+// CSP directives holding sources where relax allows inline content
+var inlineDirectives = map[string]bool{
+	"default-src": true, "script-src": true, "script-src-elem": true, "script-src-attr": true,
+	"style-src": true, "style-src-elem": true, "style-src-attr": true,
+}
+
+// CSP directives dropped by relax
+var relaxedDirectives = map[string]bool{
+	"report-uri": true, "report-to": true, "require-trusted-types-for": true, "trusted-types": true,
+}
+
+// rewriteCSP maps the host sources of a policy like
+// "script-src 'self' https://*.twimg.com; img-src twitter.com".
+// Relaxed, inline scripts and styles are allowed, nonces and hashes are
+// removed as they disable 'unsafe-inline'.
+func (p *MapGroup) rewriteCSP(policy string, relax bool) string {
+	var directives []string
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if relax && relaxedDirectives[name] {
+			continue
+		}
+
+		out := []string{fields[0]}
+		hasInline := false
+		for _, source := range fields[1:] {
+			lower := strings.ToLower(source)
+			if relax && inlineDirectives[name] {
+				if strings.HasPrefix(lower, "'nonce-") || strings.HasPrefix(lower, "'sha") || lower == "'strict-dynamic'" {
+					continue
+				}
+				if lower == "'unsafe-inline'" {
+					hasInline = true
+				}
+			}
+			if name == "report-uri" {
+				out = append(out, source)
+				continue
+			}
+			out = append(out, p.rewriteCSPSource(source)...)
+		}
+		if relax && inlineDirectives[name] && !hasInline && !hasNone(out) {
+			out = append(out, "'unsafe-inline'")
+		}
+		directives = append(directives, strings.Join(out, " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+func hasNone(fields []string) bool {
+	for _, f := range fields[1:] {
+		if strings.EqualFold(f, "'none'") {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteCSPSource returns the sources of the proxy for a host source of
+// upstream: the mapped host, or the proxy hosts of the mappings under a
+// wildcard, in addition to the source.
+func (p *MapGroup) rewriteCSPSource(source string) []string {
+	if strings.HasPrefix(source, "'") || strings.HasSuffix(source, ":") || source == "*" {
+		// keyword, nonce, hash or scheme
+		return []string{source}
+	}
+	rest := source
+	if k := strings.Index(rest, "://"); k >= 0 {
+		rest = rest[k+3:]
+	}
+	host, tail := rest, ""
+	if k := strings.IndexAny(rest, "/"); k >= 0 {
+		host, tail = rest[:k], rest[k:]
+	}
+	// mappings to a port match with it, the others without
+	mapping, proxyHost := p.proxyHost(host)
+	if h, _, ok := cutPort(host); ok {
+		host = h
+		if mapping == nil {
+			mapping, proxyHost = p.proxyHost(host)
+		}
+	}
+	if mapping != nil {
+		return []string{proxyHost + mapping.stripBase(tail)}
+	}
+
+	if strings.HasPrefix(host, "*.") {
+		base := strings.ToLower(host[2:])
+		if _, proxyHost := p.proxyHost(base); proxyHost != "" {
+			return []string{"*." + proxyHost + tail}
+		}
+		rv := []string{source}
+		for _, mapping := range p.maps {
+			if strings.HasSuffix(strings.ToLower(mapping.To), "."+base) {
+				rv = append(rv, mapping.From+tail)
+			}
+		}
+		return rv
+	}
+	return []string{source}
+}
+
+// cutPort splits "host:port", ok is false without a port.
+func cutPort(host string) (string, string, bool) {
+	k := strings.LastIndexByte(host, ':')
+	if k < 0 || strings.Contains(host[k:], "]") {
+		return host, "", false
+	}
+	return host[:k], host[k+1:], true
+}
+
+// applyCORS sets the CORS headers of the response to the client. Without a
+// CORS config, the origin allowed by upstream gets the scheme of the client.
+func (p *MapGroup) applyCORS(header http.Header, req *http.Request, mapping *DomainMapping) {
+	origin := req.Header.Get("Origin")
+	config := mapping.CORS
+	if config == nil {
+		allowed := header.Get("Access-Control-Allow-Origin")
+		if origin == "" || allowed == "" || allowed == "*" || allowed == origin {
+			return
+		}
+		o, err := url.Parse(origin)
+		a, err2 := url.Parse(allowed)
+		if err == nil && err2 == nil && strings.EqualFold(o.Host, a.Host) {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		return
+	}
+
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			header.Del(k)
+		}
+	}
+	header.Add("Vary", "Origin")
+	if origin == "" || !p.corsAllowed(config, origin) {
+		return
+	}
+
+	if config.Credentials || !contains(config.Origins, "*") {
+		header.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+	if config.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(config.ExposeHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposeHeaders, ", "))
+	}
+
+	if !isPreflight(req) {
+		return
+	}
+	if len(config.Methods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(config.Methods, ", "))
+	} else {
+		header.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	}
+	if len(config.Headers) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(config.Headers, ", "))
+	} else if h := req.Header.Get("Access-Control-Request-Headers"); h != "" {
+		header.Set("Access-Control-Allow-Headers", h)
+	}
+	if config.MaxAge.Duration > 0 {
+		header.Set("Access-Control-Max-Age", strconv.FormatInt(int64(config.MaxAge.Duration/time.Second), 10))
+	}
+}
+
+func (p *MapGroup) corsAllowed(config *CORSConfig, origin string) bool {
+	for _, allowed := range config.Origins {
+		switch allowed {
+		case "*":
+			return true
+		case "mapped":
+			if u, err := url.Parse(origin); err == nil && p.isProxyHost(u.Host) {
+				return true
+			}
+		default:
+			if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isProxyHost tells if the host is a host of a mapping or one of their
+// subdomains, matched on whole labels unlike GetMapping: a mapping from
+// example.com doesn't hold evilexample.com.
+func (p *MapGroup) isProxyHost(host string) bool {
+	host = asciiHost(host)
+	for i := range p.maps {
+		mapping := &p.maps[i]
+		if mapping.isWildcard() {
+			if strings.HasSuffix(host, mapping.From[1:]) && p.proxyWildcard(mapping, host) != nil {
+				return true
+			}
+		} else if host == mapping.From || strings.HasSuffix(host, "."+mapping.From) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteCSP(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{
+		{From: "t.byteio.cn", To: "https://twitter.com"},
+		{From: "img.byteio.cn", To: "https://twimg.com"},
+		{From: "abs.byteio.cn", To: "https://abs.twimg.com"},
+		{From: "local.byteio.cn", To: "http://127.0.0.1:8000/base"},
+		{From: "api.byteio.cn", To: "https://api.x.com"},
+	})
+	tests := []struct {
+		name   string
+		relax  bool
+		policy string
+		out    string
+	}{
+		{"keywords", false,
+			"default-src 'self' 'unsafe-eval' data: *",
+			"default-src 'self' 'unsafe-eval' data: *"},
+		{"hosts", false,
+			"img-src twitter.com https://twimg.com/path/ example.com",
+			"img-src t.byteio.cn img.byteio.cn/path/ example.com"},
+		{"subdomain", false,
+			"img-src https://pbs.twimg.com",
+			"img-src pbs.img.byteio.cn"},
+		{"wildcard of mapped", false,
+			"img-src *.twimg.com",
+			"img-src *.img.byteio.cn"},
+		{"wildcard above mappings", false,
+			"img-src https://*.example.com *.abs.example.com",
+			"img-src https://*.example.com *.abs.example.com"},
+		{"wildcard of unmapped parent", false,
+			"connect-src *.x.com",
+			"connect-src *.x.com api.byteio.cn"},
+		{"port of mapping", false,
+			"connect-src http://127.0.0.1:8000/base/api",
+			"connect-src local.byteio.cn/api"},
+		{"port not mapped", false,
+			"connect-src twitter.com:443",
+			"connect-src t.byteio.cn"},
+		{"report-uri kept", false,
+			"default-src 'self'; report-uri https://twitter.com/csp",
+			"default-src 'self'; report-uri https://twitter.com/csp"},
+		{"empty directives", false,
+			"default-src 'self';; ",
+			"default-src 'self'"},
+		{"relax", true,
+			"script-src 'nonce-abc' 'strict-dynamic' 'sha256-xyz' twitter.com; img-src 'none'; report-uri /r; trusted-types a",
+			"script-src t.byteio.cn 'unsafe-inline'; img-src 'none'"},
+		{"relax none", true,
+			"style-src 'none'",
+			"style-src 'none'"},
+		{"relax inline kept once", true,
+			"style-src 'unsafe-inline'",
+			"style-src 'unsafe-inline'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := group.rewriteCSP(tt.policy, tt.relax); got != tt.out {
+				t.Errorf("got  %v\nwant %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestCutPort(t *testing.T) {
+	tests := []struct {
+		in, host, port string
+		ok             bool
+	}{
+		{"a.com", "a.com", "", false},
+		{"a.com:80", "a.com", "80", true},
+		{"[::1]", "[::1]", "", false},
+		{"[::1]:80", "[::1]", "80", true},
+	}
+	for _, tt := range tests {
+		host, port, ok := cutPort(tt.in)
+		if host != tt.host || port != tt.port || ok != tt.ok {
+			t.Errorf("cutPort(%v) = %v %v %v", tt.in, host, port, ok)
+		}
+	}
+}
+
+func TestCORSMappedOrigins(t *testing.T) {
+	cors := &CORSConfig{Origins: []string{"mapped"}, Credentials: true}
+	group := NewMapGroup([]DomainMapping{
+		{From: "example.com", To: "https://upstream.test", CORS: cors},
+		{From: "*.proxy.test", To: "https://*", Allow: []string{"allowed.net"}},
+	})
+	mapping := &group.maps[0]
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"http://www.example.com", true},
+		{"https://Example.COM", true},
+		{"https://evilexample.com", false},
+		{"https://example.com.evil.net", false},
+		{"https://upstream.test", false},
+		{"https://allowed-net.proxy.test", true},
+		{"https://denied-net.proxy.test", false},
+		{"https://proxy.test", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Origin", tt.origin)
+		header := http.Header{}
+		group.applyCORS(header, req, mapping)
+		allowed := header.Get("Access-Control-Allow-Origin")
+		if tt.allowed && (allowed != tt.origin || header.Get("Access-Control-Allow-Credentials") != "true") {
+			t.Errorf("%v: not allowed, got %v", tt.origin, header)
+		}
+		if !tt.allowed && (allowed != "" || header.Get("Access-Control-Allow-Credentials") != "") {
+			t.Errorf("%v: allowed, got %v", tt.origin, header)
+		}
+	}
+}
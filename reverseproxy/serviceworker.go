@@ -0,0 +1,228 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ServiceWorkerPrefix is the path reserved on the proxy hosts of the mappings
+// with ServiceWorker for the scripts rewriting URLs in the browser:
+//
+//   - client.js, injected at the start of <head>, maps the URLs given to
+//     fetch, XMLHttpRequest, WebSocket, EventSource and sendBeacon, and
+//     registers the service worker
+//   - sw.js, the service worker, maps the requests of the page the client
+//     script missed, like those of images or workers
+//   - mappings.json, the mappings used by the service worker
+const ServiceWorkerPrefix = "/__proxyany/"
+
+// clientMapping is a mapping as seen by the scripts.
+type clientMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Base string `json:"base,omitempty"`
+}
+
+func (p *MapGroup) clientMappings() []byte {
+	mappings := []clientMapping{}
+	for _, mapping := range p.maps {
+		if mapping.isWildcard() {
+			continue
+		}
+		m := clientMapping{From: mapping.From, To: mapping.To}
+		if mapping.Target != nil {
+			m.Base = strings.TrimSuffix(mapping.Target.Path, "/")
+		}
+		mappings = append(mappings, m)
+	}
+	raw, _ := json.Marshal(mappings)
+	return raw
+}
+
+// serviceWorkerResponse answers the reserved paths, nil for other paths.
+func (p *MapGroup) serviceWorkerResponse(urlPath string) *proxyResponse {
+	header := make(http.Header)
+	header.Set("Cache-Control", "no-cache")
+	var body string
+	switch urlPath {
+	case ServiceWorkerPrefix + "client.js":
+		header.Set("Content-Type", "application/javascript; charset=utf-8")
+		body = "(function () {\nvar mappings = " + string(p.clientMappings()) + ";\n" + mapURLScript + clientScript + "})();\n"
+	case ServiceWorkerPrefix + "sw.js":
+		header.Set("Content-Type", "application/javascript; charset=utf-8")
+		// registered with the scope of the whole site
+		header.Set("Service-Worker-Allowed", "/")
+		body = mapURLScript + serviceWorkerScript
+	case ServiceWorkerPrefix + "mappings.json":
+		header.Set("Content-Type", "application/json")
+		body = string(p.clientMappings())
+	default:
+		return nil
+	}
+	return &proxyResponse{StatusCode: http.StatusOK, Header: header, Body: []byte(body)}
+}
+
+// serviceWorkerTag loads the client script in the pages.
+const serviceWorkerTag = `<script src="` + ServiceWorkerPrefix + `client.js"></script>`
+
+// mapURLScript defines mapURL, which maps an upstream URL to the proxy like
+// rewriteURL, and returns other URLs untouched.
+const mapURLScript = `function mapURL(mappings, url) {
+  var u;
+  try {
+    u = new URL(url, self.location.href);
+  } catch (e) {
+    return url;
+  }
+  var scheme = u.protocol;
+  if (["http:", "https:", "ws:", "wss:"].indexOf(scheme) < 0) {
+    return url;
+  }
+  var host = u.host.toLowerCase(), found = null, proxyHost = "";
+  for (var i = 0; i < mappings.length; i++) {
+    var to = mappings[i].to.toLowerCase();
+    if (host !== to && host.slice(-to.length - 1) !== "." + to) {
+      continue;
+    }
+    if (!found || to.length > found.to.length) {
+      found = mappings[i];
+      proxyHost = host.slice(0, host.length - to.length) + found.from;
+    }
+  }
+  if (!found) {
+    return url;
+  }
+  var secure = self.location.protocol === "https:";
+  if (scheme === "ws:" || scheme === "wss:") {
+    u.protocol = secure ? "wss:" : "ws:";
+  } else {
+    u.protocol = self.location.protocol;
+  }
+  u.host = proxyHost;
+  var base = found.base;
+  if (base && (u.pathname === base || u.pathname.indexOf(base + "/") === 0)) {
+    u.pathname = u.pathname.slice(base.length) || "/";
+  }
+  return u.href;
+}
+`
+
+const clientScript = `function map(url) {
+  return mapURL(mappings, String(url));
+}
+
+var fetch0 = self.fetch;
+if (fetch0) {
+  self.fetch = function (input, init) {
+    if (typeof Request !== "undefined" && input instanceof Request) {
+      var url = map(input.url);
+      if (url !== input.url) {
+        input = new Request(url, input);
+      }
+    } else {
+      input = map(input);
+    }
+    return fetch0.call(this, input, init);
+  };
+}
+
+var open0 = XMLHttpRequest.prototype.open;
+XMLHttpRequest.prototype.open = function (method, url) {
+  var args = Array.prototype.slice.call(arguments);
+  args[1] = map(url);
+  return open0.apply(this, args);
+};
+
+function wrap(name) {
+  var Orig = self[name];
+  if (!Orig) {
+    return;
+  }
+  var Wrapped = function (url, options) {
+    return arguments.length > 1 ? new Orig(map(url), options) : new Orig(map(url));
+  };
+  Wrapped.prototype = Orig.prototype;
+  ["CONNECTING", "OPEN", "CLOSING", "CLOSED"].forEach(function (k) {
+    if (k in Orig) {
+      Wrapped[k] = Orig[k];
+    }
+  });
+  self[name] = Wrapped;
+}
+wrap("WebSocket");
+wrap("EventSource");
+
+if (navigator.sendBeacon) {
+  var beacon0 = navigator.sendBeacon;
+  navigator.sendBeacon = function (url, data) {
+    return beacon0.call(navigator, map(url), data);
+  };
+}
+
+if ("serviceWorker" in navigator) {
+  navigator.serviceWorker.register("` + ServiceWorkerPrefix + `sw.js", {scope: "/"}).catch(function () {});
+}
+`
+
+const serviceWorkerScript = `var mappings = null;
+var loading = null;
+
+function load() {
+  if (!loading) {
+    loading = fetch("` + ServiceWorkerPrefix + `mappings.json").then(function (res) {
+      return res.json();
+    }).then(function (m) {
+      mappings = m;
+      return m;
+    });
+  }
+  return loading;
+}
+
+self.addEventListener("install", function (event) {
+  event.waitUntil(load().then(function () {
+    return self.skipWaiting();
+  }));
+});
+
+self.addEventListener("activate", function (event) {
+  event.waitUntil(self.clients.claim());
+});
+
+function forward(req, url) {
+  if (req.mode === "navigate") {
+    return Response.redirect(url, 302);
+  }
+  var body = req.method === "GET" || req.method === "HEAD" ? Promise.resolve(undefined) : req.arrayBuffer();
+  return body.then(function (body) {
+    return fetch(url, {
+      method: req.method,
+      headers: req.headers,
+      body: body,
+      mode: req.mode,
+      credentials: req.credentials,
+      redirect: req.redirect,
+    });
+  });
+}
+
+self.addEventListener("fetch", function (event) {
+  var req = event.request;
+  if (req.url.indexOf(self.location.origin + "/") === 0) {
+    // already on the proxy
+    return;
+  }
+  if (mappings) {
+    var url = mapURL(mappings, req.url);
+    if (url !== req.url) {
+      event.respondWith(forward(req, url));
+    }
+    return;
+  }
+  event.respondWith(load().then(function (m) {
+    var url = mapURL(m, req.url);
+    return url !== req.url ? forward(req, url) : fetch(req);
+  }));
+});
+`
@@ -0,0 +1,72 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceWorkerScripts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{
+		{From: "sw.proxy.test", To: "https://example.net/base/", ServiceWorker: true},
+		{From: "img.proxy.test", To: "https://bücher.example"},
+		{From: "*.w.proxy.test", To: "https://*", Allow: []string{"*"}},
+		{From: "plain.proxy.test", To: upstream.URL},
+	}))
+	get := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+path, nil)
+		rw := httptest.NewRecorder()
+		proxy.ProxyHTTP(rw, req)
+		return rw
+	}
+	want := []clientMapping{
+		{From: "sw.proxy.test", To: "example.net", Base: "/base"},
+		{From: "img.proxy.test", To: "xn--bcher-kva.example"},
+		{From: "plain.proxy.test", To: strings.TrimPrefix(upstream.URL, "http://")},
+	}
+
+	rw := get("sw.proxy.test", ServiceWorkerPrefix+"client.js")
+	client := rw.Body.String()
+	if rw.Code != 200 || !strings.HasPrefix(rw.Header().Get("Content-Type"), "application/javascript") {
+		t.Errorf("client.js: got %v %v", rw.Code, rw.Header())
+	}
+	for _, m := range want {
+		raw, _ := json.Marshal(m)
+		if !strings.Contains(client, string(raw)) {
+			t.Errorf("client.js: no mapping %s", raw)
+		}
+	}
+	if strings.Contains(client, "*.w.proxy.test") {
+		t.Error("client.js: wildcard mapping included")
+	}
+	if !strings.Contains(client, "function mapURL(") {
+		t.Error("client.js: no mapURL")
+	}
+
+	rw = get("sw.proxy.test", ServiceWorkerPrefix+"mappings.json")
+	var mappings []clientMapping
+	if err := json.Unmarshal(rw.Body.Bytes(), &mappings); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("mappings.json: got %+v, want %+v", mappings, want)
+	}
+
+	rw = get("sw.proxy.test", ServiceWorkerPrefix+"sw.js")
+	if rw.Code != 200 || rw.Header().Get("Service-Worker-Allowed") != "/" || !strings.Contains(rw.Body.String(), "function mapURL(") {
+		t.Errorf("sw.js: got %v %v", rw.Code, rw.Header())
+	}
+
+	// the mappings without service worker proxy the path
+	rw = get("plain.proxy.test", ServiceWorkerPrefix+"client.js")
+	if got := rw.Body.String(); got != "upstream "+ServiceWorkerPrefix+"client.js" {
+		t.Errorf("plain mapping: got %q", got)
+	}
+}
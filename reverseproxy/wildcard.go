@@ -0,0 +1,206 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// A wildcard mapping, like
+//
+//	{"from": "*.proxy.example.com", "to": "https://*", "allow": ["example.com"]}
+//
+// proxies any upstream host encoded as a single label of its proxy domain:
+// "-" becomes "--" and "." becomes "-", so www.my-site.com is reached at
+// www-my--site-com.proxy.example.com. The other fields of the mapping apply
+// to every host it proxies.
+//
+// Upstream hosts must be domain names on the default port of the scheme.
+// IP addresses, localhost and hosts of the proxy are never proxied, nor the
+// names resolving to addresses which are not public, see followDialer.
+
+// wildcardContextKey marks the requests to the hosts of wildcard mappings.
+type wildcardContextKey struct{}
+
+func (p *DomainMapping) isWildcard() bool {
+	return strings.HasPrefix(p.From, "*.")
+}
+
+// Wildcard tells the mapping was made by a wildcard mapping for a host.
+func (p *DomainMapping) Wildcard() bool {
+	return p.wildcard
+}
+
+func validateWildcard(mapping *DomainMapping) error {
+	if !mapping.isWildcard() {
+		if mapping.To == "*" || len(mapping.Allow) > 0 || len(mapping.Deny) > 0 {
+			return fmt.Errorf("mapping %v: to \"*\", allow and deny need a from like \"*.proxy.example.com\"", mapping.From)
+		}
+		return nil
+	}
+	if mapping.To != "*" {
+		return fmt.Errorf("mapping %v: a wildcard from needs a to like \"https://*\"", mapping.From)
+	}
+	if len(mapping.Allow) == 0 {
+		return fmt.Errorf("mapping %v: a wildcard mapping needs an allow list, [\"*\"] for any domain", mapping.From)
+	}
+	for _, domain := range append(mapping.Allow, mapping.Deny...) {
+		if domain == "" || strings.ContainsAny(domain, "/:") {
+			return fmt.Errorf("mapping %v: invalid domain %q", mapping.From, domain)
+		}
+	}
+	return nil
+}
+
+// encodeHost returns the label of an upstream host.
+func encodeHost(host string) string {
+	return strings.Replace(strings.Replace(host, "-", "--", -1), ".", "-", -1)
+}
+
+// decodeHost returns the upstream host of a label.
+func decodeHost(label string) string {
+	var out strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '-' {
+			out.WriteByte(label[i])
+		} else if i+1 < len(label) && label[i+1] == '-' {
+			out.WriteByte('-')
+			i++
+		} else {
+			out.WriteByte('.')
+		}
+	}
+	return out.String()
+}
+
+// matchDomain tells if the host is one of the domains or of their subdomains,
+// "*" matches any host.
+func matchDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var hostLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// wildcardAllowed tells if the wildcard mapping proxies the upstream host,
+// given in lower case A-labels.
+func (p *MapGroup) wildcardAllowed(mapping *DomainMapping, host string) bool {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 || net.ParseIP(host) != nil || labels[len(labels)-1] == "localhost" {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) > 63 || !hostLabel.MatchString(label) {
+			return false
+		}
+	}
+	if _, found := p.staticMapping(host); found || p.wildcardOf(host) != nil {
+		// a host of the proxy
+		return false
+	}
+	if matchDomain(mapping.Deny, host) {
+		return false
+	}
+	return matchDomain(mapping.Allow, host)
+}
+
+// wildcardOf returns the wildcard mapping whose proxy domain holds the host.
+func (p *MapGroup) wildcardOf(host string) *DomainMapping {
+	for i := range p.maps {
+		mapping := &p.maps[i]
+		if mapping.isWildcard() && strings.HasSuffix(host, mapping.From[1:]) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// staticMapping tells if the host is a proxy host of a mapping not wildcard.
+func (p *MapGroup) staticMapping(host string) (DomainMapping, bool) {
+	for _, mapping := range p.maps {
+		if !mapping.isWildcard() && strings.HasSuffix(host, mapping.From) {
+			return mapping, true
+		}
+	}
+	return DomainMapping{}, false
+}
+
+// wildcardMapping returns the mapping proxying the upstream host through the
+// wildcard mapping, from the proxy host.
+func (p *MapGroup) wildcardMapping(wildcard *DomainMapping, proxyHost, upstream string) *DomainMapping {
+	mapping := *wildcard
+	mapping.From = proxyHost
+	mapping.To = upstream
+	target := *wildcard.Target
+	target.Host = upstream
+	mapping.Target = &target
+	mapping.wildcard = true
+	return &mapping
+}
+
+// proxyWildcard returns the mapping of a proxy host of the wildcard mapping.
+func (p *MapGroup) proxyWildcard(wildcard *DomainMapping, host string) *DomainMapping {
+	label := strings.TrimSuffix(host, wildcard.From[1:])
+	if label == "" || strings.Contains(label, ".") {
+		return nil
+	}
+	upstream := asciiHost(decodeHost(label))
+	if !p.wildcardAllowed(wildcard, upstream) {
+		return nil
+	}
+	return p.wildcardMapping(wildcard, host, upstream)
+}
+
+// upstreamWildcard returns the mapping of an upstream host proxied by a
+// wildcard mapping, and its proxy host.
+func (p *MapGroup) upstreamWildcard(host string) (*DomainMapping, string) {
+	for i := range p.maps {
+		wildcard := &p.maps[i]
+		if !wildcard.isWildcard() || !p.wildcardAllowed(wildcard, host) {
+			continue
+		}
+		label := encodeHost(host)
+		if len(label) > 63 {
+			continue
+		}
+		proxyHost := label + wildcard.From[1:]
+		return p.wildcardMapping(wildcard, proxyHost, host), proxyHost
+	}
+	return nil, ""
+}
+
+var (
+	hasWildcardURLs = regexp.MustCompile(`(?i)(?:https?:)?//`)
+	wildcardURL     = regexp.MustCompile(`(?i)(https?:)?//((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9])([/?#"'\\\s)]|$)`)
+)
+
+// replaceWildcardHosts makes the URLs of upstream hosts proxied by wildcard
+// mappings protocol relative URLs of their proxy hosts.
+func (p *MapGroup) replaceWildcardHosts(body []byte) []byte {
+	if !p.hasWildcard() || !hasWildcardURLs.Match(body) {
+		return body
+	}
+	return wildcardURL.ReplaceAllFunc(body, func(match []byte) []byte {
+		m := wildcardURL.FindSubmatch(match)
+		host := strings.ToLower(string(m[2]))
+		if _, proxyHost := p.upstreamWildcard(host); proxyHost != "" {
+			return append([]byte("//"+proxyHost), m[3]...)
+		}
+		return match
+	})
+}
+
+func (p *MapGroup) hasWildcard() bool {
+	for i := range p.maps {
+		if p.maps[i].isWildcard() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEncodeHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		label string
+	}{
+		{"example.com", "example-com"},
+		{"www.my-site.com", "www-my--site-com"},
+		{"a--b.example.com", "a----b-example-com"},
+		{"xn--bcher-kva.example", "xn----bcher--kva-example"},
+	}
+	for _, tt := range tests {
+		if got := encodeHost(tt.host); got != tt.label {
+			t.Errorf("encodeHost(%q) = %q, want %q", tt.host, got, tt.label)
+		}
+		if got := decodeHost(tt.label); got != tt.host {
+			t.Errorf("decodeHost(%q) = %q, want %q", tt.label, got, tt.host)
+		}
+	}
+}
+
+func TestDecodeHost(t *testing.T) {
+	tests := []struct {
+		label string
+		host  string
+	}{
+		{"", ""},
+		{"-", "."},
+		{"a-", "a."},
+		{"-a", ".a"},
+		{"a---b", "a-.b"},
+		{"a--", "a-"},
+		{"a-b--c-d", "a.b-c.d"},
+	}
+	for _, tt := range tests {
+		if got := decodeHost(tt.label); got != tt.host {
+			t.Errorf("decodeHost(%q) = %q, want %q", tt.label, got, tt.host)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		domains []string
+		host    string
+		want    bool
+	}{
+		{nil, "example.com", false},
+		{[]string{"*"}, "example.com", true},
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "www.example.com", true},
+		{[]string{".Example.com"}, "www.example.com", true},
+		{[]string{"example.com"}, "badexample.com", false},
+		{[]string{"example.com"}, "example.com.evil.net", false},
+		{[]string{"www.example.com"}, "example.com", false},
+		{[]string{"example.org", "example.com"}, "a.example.com", true},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(tt.domains, tt.host); got != tt.want {
+			t.Errorf("matchDomain(%q, %q) = %v, want %v", tt.domains, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestWildcardAllowed(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{
+		{From: "*.proxy.test", To: "https://*", Allow: []string{"example.com", "example.org"}, Deny: []string{"login.example.com"}},
+		{From: "any.test", To: "https://mapped.net"},
+		{From: "*.open.test", To: "https://*", Allow: []string{"*"}},
+	})
+	wildcard, open := &group.maps[0], &group.maps[2]
+	tests := []struct {
+		mapping *DomainMapping
+		host    string
+		want    bool
+	}{
+		{wildcard, "example.com", true},
+		{wildcard, "www.example.org", true},
+		{wildcard, "example.net", false},
+		{wildcard, "login.example.com", false},
+		{wildcard, "a.login.example.com", false},
+		{open, "example.net", true},
+		{open, "com", false},
+		{open, "127.0.0.1", false},
+		{open, "a.localhost", false},
+		{open, "-a.example.net", false},
+		{open, "a_b.example.net", false},
+		{open, "any.test", false},
+		{open, "x.proxy.test", false},
+		{open, "www.open.test", false},
+	}
+	for _, tt := range tests {
+		if got := group.wildcardAllowed(tt.mapping, tt.host); got != tt.want {
+			t.Errorf("%v %q: got %v, want %v", tt.mapping.From, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGetMappingWildcard(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{
+		{From: "*.proxy.test", To: "https://*", Allow: []string{"example.com"}},
+	})
+	tests := []struct {
+		host     string
+		upstream string
+	}{
+		{"www-example-com.proxy.test", "www.example.com"},
+		{"my--site-example-com.proxy.test", "my-site.example.com"},
+		{"example-org.proxy.test", ""},
+		{"a.example-com.proxy.test", ""},
+		{"proxy.test", ""},
+	}
+	for _, tt := range tests {
+		mapping := group.GetMapping(tt.host)
+		if tt.upstream == "" {
+			if mapping != nil {
+				t.Errorf("%v: got %v", tt.host, mapping.To)
+			}
+			continue
+		}
+		if mapping == nil || mapping.To != tt.upstream || mapping.Target.Host != tt.upstream || !mapping.Wildcard() {
+			t.Errorf("%v: got %+v, want %v", tt.host, mapping, tt.upstream)
+		}
+	}
+}
+
+func TestValidateWildcard(t *testing.T) {
+	tests := []struct {
+		mapping DomainMapping
+		ok      bool
+	}{
+		{DomainMapping{From: "*.proxy.test", To: "*", Allow: []string{"*"}}, true},
+		{DomainMapping{From: "*.proxy.test", To: "*", Allow: []string{"example.com"}}, true},
+		{DomainMapping{From: "*.proxy.test", To: "*"}, false},
+		{DomainMapping{From: "*.proxy.test", To: "*", Deny: []string{"example.com"}}, false},
+		{DomainMapping{From: "*.proxy.test", To: "example.com", Allow: []string{"*"}}, false},
+		{DomainMapping{From: "*.proxy.test", To: "*", Allow: []string{"example.com/"}}, false},
+		{DomainMapping{From: "proxy.test", To: "*"}, false},
+		{DomainMapping{From: "proxy.test", To: "example.com", Allow: []string{"*"}}, false},
+		{DomainMapping{From: "proxy.test", To: "example.com"}, true},
+	}
+	for _, tt := range tests {
+		if err := validateWildcard(&tt.mapping); (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v", tt.mapping, err)
+		}
+	}
+}
+
+func TestUpstreamWildcardLongLabel(t *testing.T) {
+	group := NewMapGroup([]DomainMapping{{From: "*.proxy.test", To: "https://*", Allow: []string{"*"}}})
+	long := strings.Repeat("a", 30) + "." + strings.Repeat("b", 30) + ".com"
+	if mapping, proxyHost := group.upstreamWildcard(long); mapping != nil || proxyHost != "" {
+		t.Errorf("got %v for a label of %v bytes", proxyHost, len(encodeHost(long)))
+	}
+	if _, proxyHost := group.upstreamWildcard("a.example.com"); proxyHost != "a-example-com.proxy.test" {
+		t.Errorf("got %q", proxyHost)
+	}
+}
+
+func TestWildcardDialsPublicOnly(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	transport := NewReverseProxy(NewMapGroup(nil)).Transport
+
+	// localhost resolves to 127.0.0.1
+	req := httptest.NewRequest("GET", "http://localhost:"+port+"/", nil)
+	req.RequestURI = ""
+	if res, err := transport.RoundTrip(req.WithContext(context.WithValue(req.Context(), wildcardContextKey{}, true))); err == nil {
+		res.Body.Close()
+		t.Error("dialed a loopback address")
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Error("upstream reached")
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Error("mapped upstream not reached")
+	}
+}
+
+// serveTestDNS answers the A queries of every name with 127.0.0.1, and
+// the others with no record.
+func serveTestDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the question, then the answer pointing at its name
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += 1 + int(buf[end])
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			res := append([]byte{buf[0], buf[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, buf[12:end]...)
+			if buf[end-4] == 0 && buf[end-3] == 1 {
+				res[7] = 1
+				res = append(res, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestWildcardNameResolvingToLoopback(t *testing.T) {
+	server := serveTestDNS(t)
+	defer func(resolver *net.Resolver) { net.DefaultResolver = resolver }(net.DefaultResolver)
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", server)
+		},
+	}
+
+	proxy := NewReverseProxy(NewMapGroup([]DomainMapping{{From: "*.proxy.test", To: "http://*", Allow: []string{"*"}}}))
+	var logged bytes.Buffer
+	proxy.ErrorLog = log.New(&logged, "", 0)
+
+	rw := httptest.NewRecorder()
+	proxy.ProxyHTTP(rw, httptest.NewRequest("GET", "http://internal-example-com.proxy.test/", nil))
+	if rw.Code != http.StatusBadGateway || !strings.Contains(logged.String(), "non public address 127.0.0.1 refused") {
+		t.Errorf("got %v, logged %q", rw.Code, logged.String())
+	}
+}
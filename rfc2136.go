@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// RFC2136 is the DNS provider updating the TXT records of an authoritative
+// server with DNS UPDATE messages, RFC 2136, signed by TSIG, RFC 8945. It
+// works with BIND, Knot, PowerDNS and the like.
+type RFC2136 struct {
+	Server string // host[:port]
+	Zone   string // zone updated, holding the _acme-challenge names
+	TTL    uint32
+
+	// TSIG key, unsigned updates without name
+	TSIGKey       string
+	TSIGSecret    string // base64
+	TSIGAlgorithm string // like hmac-sha256
+}
+
+// TSIG algorithms
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha224": sha256.New224,
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+// DNS constants
+const (
+	dnsTypeSOA   = 6
+	dnsTypeTXT   = 16
+	dnsTypeTSIG  = 250
+	dnsClassIN   = 1
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	dnsOpUpdate  = 5
+	tsigFudge    = 300
+)
+
+var dnsRcodes = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+	// TSIG errors
+	16: "BADSIG", 17: "BADKEY", 18: "BADTIME", 22: "BADTRUNC",
+}
+
+func dnsRcode(rcode int) string {
+	if name := dnsRcodes[rcode]; name != "" {
+		return name
+	}
+	return fmt.Sprint(rcode)
+}
+
+func newRFC2136FromFlags() (DNSProvider, error) {
+	p := &RFC2136{
+		Server:        rfc2136Server,
+		Zone:          rfc2136Zone,
+		TTL:           uint32(rfc2136TTL),
+		TSIGKey:       rfc2136TSIGKey,
+		TSIGSecret:    rfc2136TSIGSecret,
+		TSIGAlgorithm: rfc2136TSIGAlgorithm,
+	}
+	if p.Server == "" || p.Zone == "" {
+		return nil, errors.New("rfc2136: -rfc2136-server and -rfc2136-zone are required")
+	}
+	if p.TSIGKey != "" {
+		if _, ok := tsigAlgorithms[strings.ToLower(p.TSIGAlgorithm)]; !ok {
+			return nil, fmt.Errorf("rfc2136: unknown TSIG algorithm %v", p.TSIGAlgorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(p.TSIGSecret); err != nil {
+			return nil, fmt.Errorf("rfc2136: invalid TSIG secret: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// Present adds the TXT record.
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+// CleanUp deletes the TXT record, the other values of the name are kept.
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, remove bool) error {
+	zone := strings.ToLower(dnsFQDN(p.Zone))
+	fqdn = strings.ToLower(dnsFQDN(fqdn))
+	if fqdn != zone && !strings.HasSuffix(fqdn, "."+zone) {
+		return fmt.Errorf("rfc2136: %v is not in zone %v", fqdn, zone)
+	}
+	msg, id, mac, err := p.message(zone, fqdn, value, remove)
+	if err != nil {
+		return err
+	}
+	res, err := dnsExchange(ctx, p.Server, msg)
+	if err != nil {
+		return fmt.Errorf("rfc2136: %v", err)
+	}
+	if len(res) < 12 || binary.BigEndian.Uint16(res) != id || res[2]&0x80 == 0 {
+		return errors.New("rfc2136: invalid response")
+	}
+	rcode := int(res[3] & 0x0f)
+	if p.TSIGKey != "" {
+		// a forged answer must not pass for a done update
+		if err := p.verify(res, id, mac, time.Now()); err != nil {
+			return fmt.Errorf("rfc2136: update of %v, %v response: %v", fqdn, dnsRcode(rcode), err)
+		}
+	}
+	if rcode != 0 {
+		return fmt.Errorf("rfc2136: update of %v refused: %v", fqdn, dnsRcode(rcode))
+	}
+	return nil
+}
+
+// message builds the UPDATE message, signed with the TSIG key if any, and
+// returns it with its id and MAC.
+func (p *RFC2136) message(zone, fqdn, value string, remove bool) ([]byte, uint16, []byte, error) {
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+
+	// header: zone count 1, update count 1
+	msg := []byte{idb[0], idb[1], dnsOpUpdate << 3, 0, 0, 1, 0, 0, 0, 1, 0, 0}
+	// zone section
+	zoneName, err := dnsName(zone)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	msg = append(msg, zoneName...)
+	msg = appendUint16(msg, dnsTypeSOA, dnsClassIN)
+
+	// update section, RFC 2136 section 2.5.1 and 2.5.4
+	name, err := dnsName(fqdn)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(value) > 255 {
+		return nil, 0, nil, errors.New("rfc2136: TXT value too long")
+	}
+	class, ttl := uint16(dnsClassIN), p.TTL
+	if remove {
+		class, ttl = dnsClassNone, 0
+	}
+	msg = append(msg, name...)
+	msg = appendUint16(msg, dnsTypeTXT, class)
+	msg = appendUint32(msg, ttl)
+	msg = appendUint16(msg, uint16(1+len(value)))
+	msg = append(msg, byte(len(value)))
+	msg = append(msg, value...)
+
+	if p.TSIGKey == "" {
+		return msg, id, nil, nil
+	}
+	msg, mac, err := p.sign(msg, id, time.Now())
+	return msg, id, mac, err
+}
+
+// tsigKey is the TSIG key in wire format.
+type tsigKey struct {
+	name      []byte
+	algorithm []byte
+	newHash   func() hash.Hash
+	secret    []byte
+}
+
+func (p *RFC2136) tsigKey() (*tsigKey, error) {
+	secret, err := base64.StdEncoding.DecodeString(p.TSIGSecret)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := strings.ToLower(p.TSIGAlgorithm)
+	newHash, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("rfc2136: unknown TSIG algorithm %v", p.TSIGAlgorithm)
+	}
+	name, err := dnsName(strings.ToLower(dnsFQDN(p.TSIGKey)))
+	if err != nil {
+		return nil, err
+	}
+	algName, _ := dnsName(algorithm + ".")
+	return &tsigKey{name: name, algorithm: algName, newHash: newHash, secret: secret}, nil
+}
+
+// mac returns the MAC of the message, without its TSIG record, then the TSIG
+// variables, RFC 8945 section 4.3. The MAC of the request comes first for
+// a response.
+func (p *tsigKey) mac(requestMAC, msg, timeSigned []byte, fudge, tsigError uint16, other []byte) []byte {
+	mac := hmac.New(p.newHash, p.secret)
+	if requestMAC != nil {
+		mac.Write(appendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	vars := append([]byte{}, p.name...)
+	vars = appendUint16(vars, dnsClassAny)
+	vars = appendUint32(vars, 0)
+	vars = append(vars, p.algorithm...)
+	vars = append(vars, timeSigned...)
+	vars = appendUint16(vars, fudge, tsigError, uint16(len(other)))
+	vars = append(vars, other...)
+	mac.Write(vars)
+	return mac.Sum(nil)
+}
+
+// sign appends the TSIG record of the message, RFC 8945 section 4, and
+// returns the MAC.
+func (p *RFC2136) sign(msg []byte, id uint16, now time.Time) ([]byte, []byte, error) {
+	key, err := p.tsigKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := uint64(now.Unix())
+	timeSigned := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+	sum := key.mac(nil, msg, timeSigned, tsigFudge, 0, nil)
+
+	rdata := append([]byte{}, key.algorithm...)
+	rdata = append(rdata, timeSigned...)
+	rdata = appendUint16(rdata, tsigFudge, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id, 0, 0) // original id, error, other len
+
+	out := append([]byte{}, msg...)
+	out = append(out, key.name...)
+	out = appendUint16(out, dnsTypeTSIG, dnsClassAny)
+	out = appendUint32(out, 0)
+	out = appendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	// additional count
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, sum, nil
+}
+
+// verify checks the TSIG record of the response to the request of the id
+// and MAC, RFC 8945 section 5.3.
+func (p *RFC2136) verify(res []byte, id uint16, requestMAC []byte, now time.Time) error {
+	key, err := p.tsigKey()
+	if err != nil {
+		return err
+	}
+	errInvalid := errors.New("malformed response")
+
+	// the TSIG record is the last one
+	records := 0
+	for i := 6; i < 12; i += 2 {
+		records += int(binary.BigEndian.Uint16(res[i:]))
+	}
+	if binary.BigEndian.Uint16(res[10:]) == 0 {
+		return errors.New("unsigned response")
+	}
+	off := 12
+	for questions := binary.BigEndian.Uint16(res[4:]); questions > 0; questions-- {
+		if off, err = skipDNSName(res, off); err != nil {
+			return errInvalid
+		}
+		off += 4
+	}
+	for ; records > 1; records-- {
+		if off, err = skipDNSName(res, off); err != nil || off+10 > len(res) {
+			return errInvalid
+		}
+		off += 10 + int(binary.BigEndian.Uint16(res[off+8:]))
+	}
+	start := off
+	if off, err = skipDNSName(res, off); err != nil || off+10 > len(res) ||
+		binary.BigEndian.Uint16(res[off:]) != dnsTypeTSIG {
+		return errors.New("unsigned response")
+	}
+	rdata := res[off+10:]
+	if len(rdata) != int(binary.BigEndian.Uint16(res[off+8:])) ||
+		!bytes.HasPrefix(bytes.ToLower(rdata), key.algorithm) || len(rdata) < len(key.algorithm)+10 {
+		return errInvalid
+	}
+	rdata = rdata[len(key.algorithm):]
+	timeSigned, fudge := rdata[:6], binary.BigEndian.Uint16(rdata[6:])
+	macSize := int(binary.BigEndian.Uint16(rdata[8:]))
+	if len(rdata) < 10+macSize+6 {
+		return errInvalid
+	}
+	mac := rdata[10 : 10+macSize]
+	rdata = rdata[10+macSize:]
+	originalID, tsigError := binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:])
+	other := rdata[6:]
+	if len(other) != int(binary.BigEndian.Uint16(rdata[4:])) {
+		return errInvalid
+	}
+	if tsigError != 0 {
+		return fmt.Errorf("TSIG error %v", dnsRcode(int(tsigError)))
+	}
+	if originalID != id {
+		return errInvalid
+	}
+
+	// the response as signed: without the TSIG record, with the original id
+	msg := append([]byte{}, res[:start]...)
+	binary.BigEndian.PutUint16(msg, originalID)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	if !hmac.Equal(mac, key.mac(requestMAC, msg, timeSigned, fudge, tsigError, other)) {
+		return errors.New("TSIG signature mismatch")
+	}
+	signed := int64(timeSigned[0])<<40 | int64(timeSigned[1])<<32 | int64(binary.BigEndian.Uint32(timeSigned[2:]))
+	if delta := now.Unix() - signed; delta > int64(fudge) || -delta > int64(fudge) {
+		return errors.New("TSIG time out of the fudge")
+	}
+	return nil
+}
+
+// skipDNSName returns the offset after the name at off, compressed or not.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("truncated DNS message")
+		}
+		c := int(msg[off])
+		switch {
+		case c == 0:
+			return off + 1, nil
+		case c&0xc0 == 0xc0:
+			return off + 2, nil
+		case c&0xc0 != 0:
+			return 0, errors.New("invalid DNS name")
+		}
+		off += 1 + c
+	}
+}
+
+// dnsExchange sends the message over UDP, over TCP if the response is
+// truncated, and returns the response.
+func dnsExchange(ctx context.Context, server string, msg []byte) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// responses of other ids are stale or forged
+		if n < 12 || buf[0] != msg[0] || buf[1] != msg[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+
+	// truncated
+	tcp, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(deadline)
+	if _, err := tcp.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(tcp, buf[:2]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(tcp, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func dnsFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// dnsName returns the wire format of the absolute name, uncompressed.
+func dnsName(name string) ([]byte, error) {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			if name == "." {
+				break
+			}
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("DNS label too long in %q", name)
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	out = append(out, 0)
+	if len(out) > 255 {
+		return nil, fmt.Errorf("DNS name too long %q", name)
+	}
+	return out, nil
+}
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testTSIGSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestRFC2136(server string) *RFC2136 {
+	return &RFC2136{
+		Server:        server,
+		Zone:          "example.com",
+		TTL:           60,
+		TSIGKey:       "acme-key",
+		TSIGSecret:    base64.StdEncoding.EncodeToString(testTSIGSecret),
+		TSIGAlgorithm: "hmac-sha256",
+	}
+}
+
+// wire returns the uncompressed wire format of the name.
+func wire(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+func be16(v ...uint16) []byte {
+	var out []byte
+	for _, x := range v {
+		out = append(out, byte(x>>8), byte(x))
+	}
+	return out
+}
+
+// testTSIG is the TSIG record of a test message.
+type testTSIG struct {
+	time      uint64
+	fudge     uint16
+	mac       []byte
+	id        uint16
+	tsigError uint16
+}
+
+// tsigMAC computes the MAC of RFC 8945 section 4.3 of hmac-sha256 for the key
+// acme-key.
+func tsigMAC(requestMAC, msg []byte, tsig testTSIG) []byte {
+	mac := hmac.New(sha256.New, testTSIGSecret)
+	if requestMAC != nil {
+		mac.Write(be16(uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	mac.Write(wire("acme-key."))
+	mac.Write(be16(255, 0, 0)) // class ANY, TTL 0
+	mac.Write(wire("hmac-sha256."))
+	mac.Write(be16(uint16(tsig.time>>32), uint16(tsig.time>>16), uint16(tsig.time)))
+	mac.Write(be16(tsig.fudge, tsig.tsigError, 0))
+	return mac.Sum(nil)
+}
+
+// parseTSIG splits the message, with one TSIG record last, into the message
+// as signed and its record.
+func parseTSIG(msg []byte) ([]byte, testTSIG, error) {
+	owner := append(wire("acme-key."), be16(250, 255, 0, 0)...)
+	start := bytes.LastIndex(msg, owner)
+	if start < 0 {
+		return nil, testTSIG{}, fmt.Errorf("no TSIG record in %x", msg)
+	}
+	rdata := msg[start+len(owner)+2:]
+	if int(binary.BigEndian.Uint16(msg[start+len(owner):])) != len(rdata) || !bytes.HasPrefix(rdata, wire("hmac-sha256.")) || len(rdata) < 29 {
+		return nil, testTSIG{}, fmt.Errorf("invalid TSIG rdata %x", rdata)
+	}
+	rdata = rdata[len(wire("hmac-sha256.")):]
+	var tsig testTSIG
+	tsig.time = uint64(binary.BigEndian.Uint16(rdata))<<32 | uint64(binary.BigEndian.Uint32(rdata[2:]))
+	tsig.fudge = binary.BigEndian.Uint16(rdata[6:])
+	size := int(binary.BigEndian.Uint16(rdata[8:]))
+	if len(rdata) != 16+size {
+		return nil, testTSIG{}, fmt.Errorf("invalid TSIG rdata %x", rdata)
+	}
+	tsig.mac = rdata[10 : 10+size]
+	tsig.id = binary.BigEndian.Uint16(rdata[10+size:])
+	tsig.tsigError = binary.BigEndian.Uint16(rdata[12+size:])
+	if other := binary.BigEndian.Uint16(rdata[14+size:]); other != 0 {
+		return nil, testTSIG{}, fmt.Errorf("other data in %x", rdata)
+	}
+
+	signed := append([]byte{}, msg[:start]...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])-1)
+	return signed, tsig, nil
+}
+
+// testResponse returns the response to the request, with the rcode, signed
+// after the MAC of the request if sign.
+func testResponse(request []byte, requestMAC []byte, rcode byte, sign bool, tsig testTSIG) []byte {
+	zone := wire("example.com.")
+	res := []byte{request[0], request[1], 0x80 | request[2], rcode, 0, 1, 0, 0, 0, 0, 0, 0}
+	res = append(res, zone...)
+	res = append(res, be16(6, 1)...) // SOA IN
+	if !sign {
+		return res
+	}
+	if tsig.mac == nil {
+		tsig.mac = tsigMAC(requestMAC, res, tsig)
+	}
+	res[11] = 1
+	res = append(res, wire("acme-key.")...)
+	res = append(res, be16(250, 255, 0, 0)...)
+	rdata := append(wire("hmac-sha256."), be16(uint16(tsig.time>>32), uint16(tsig.time>>16), uint16(tsig.time))...)
+	rdata = append(rdata, be16(tsig.fudge, uint16(len(tsig.mac)))...)
+	rdata = append(rdata, tsig.mac...)
+	rdata = append(rdata, be16(tsig.id, tsig.tsigError, 0)...)
+	res = append(res, be16(uint16(len(rdata)))...)
+	return append(res, rdata...)
+}
+
+// serveDNS answers one message over UDP, and over TCP when truncated.
+func serveDNS(t *testing.T, answer func(request []byte) (res []byte, truncated bool)) string {
+	t.Helper()
+	var udp net.PacketConn
+	var tcp net.Listener
+	for i := 0; tcp == nil; i++ {
+		var err error
+		if udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		// the same port for TCP
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err != nil {
+			udp.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		n, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		res, truncated := answer(buf[:n])
+		if truncated {
+			udp.WriteTo([]byte{buf[0], buf[1], 0x80 | buf[2] | 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0}, addr)
+		} else {
+			udp.WriteTo(res, addr)
+			return
+		}
+
+		conn, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		res, _ = answer(msg)
+		conn.Write(append(be16(uint16(len(res))), res...))
+	}()
+	return udp.LocalAddr().String()
+}
+
+func TestRFC2136Update(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		requests := make(chan []byte, 1)
+		server := serveDNS(t, func(request []byte) ([]byte, bool) {
+			requests <- append([]byte{}, request...)
+			_, tsig, _ := parseTSIG(request)
+			return testResponse(request, tsig.mac, 0, true, testTSIG{time: uint64(time.Now().Unix()), fudge: 300, id: tsig.id}), false
+		})
+		provider := newTestRFC2136(server)
+		var err error
+		if remove {
+			err = provider.CleanUp(context.Background(), "_acme-challenge.www.example.com.", "token-value")
+		} else {
+			err = provider.Present(context.Background(), "_acme-challenge.www.example.com.", "token-value")
+		}
+		if err != nil {
+			t.Fatalf("remove %v: %v", remove, err)
+		}
+
+		got := <-requests
+		signed, tsig, err := parseTSIG(got)
+		if err != nil {
+			t.Fatalf("remove %v: %v", remove, err)
+		}
+		// header: opcode UPDATE, one zone, one update, the TSIG record
+		if signed[2] != 5<<3 || signed[3] != 0 || !bytes.Equal(signed[4:12], be16(1, 0, 1, 0)) || !bytes.Equal(got[10:12], be16(1)) {
+			t.Errorf("remove %v: header %x", remove, got[:12])
+		}
+		want := append(wire("example.com."), be16(6, 1)...) // SOA IN
+		want = append(want, wire("_acme-challenge.www.example.com.")...)
+		if remove {
+			want = append(want, be16(16, 254, 0, 0)...) // TXT NONE, TTL 0
+		} else {
+			want = append(want, be16(16, 1, 0, 60)...) // TXT IN, TTL 60
+		}
+		want = append(want, be16(12)...)
+		want = append(want, "\x0btoken-value"...)
+		if !bytes.Equal(signed[12:], want) {
+			t.Errorf("remove %v: got\n%x\nwant\n%x", remove, signed[12:], want)
+		}
+
+		if tsig.id != binary.BigEndian.Uint16(got) || tsig.fudge != 300 || tsig.tsigError != 0 {
+			t.Errorf("remove %v: TSIG %+v", remove, tsig)
+		}
+		if delta := time.Now().Unix() - int64(tsig.time); delta < 0 || delta > 5 {
+			t.Errorf("remove %v: signed %v", remove, tsig.time)
+		}
+		if !hmac.Equal(tsig.mac, tsigMAC(nil, signed, tsig)) {
+			t.Errorf("remove %v: invalid MAC", remove)
+		}
+	}
+}
+
+func TestRFC2136TCPFallback(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	server := serveDNS(t, func(request []byte) ([]byte, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		_, tsig, _ := parseTSIG(request)
+		return testResponse(request, tsig.mac, 0, true, testTSIG{time: uint64(time.Now().Unix()), fudge: 300, id: tsig.id}), requests == 1
+	})
+	if err := newTestRFC2136(server).Present(context.Background(), "_acme-challenge.example.com", "v"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("%v requests, want the UDP then the TCP one", requests)
+	}
+}
+
+func TestRFC2136Response(t *testing.T) {
+	now := uint64(time.Now().Unix())
+	tests := []struct {
+		name     string
+		response func(request []byte, tsig testTSIG) []byte
+		err      string
+	}{
+		{"signed", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 0, true, testTSIG{time: now, fudge: 300, id: tsig.id})
+		}, ""},
+		{"refused", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 5, true, testTSIG{time: now, fudge: 300, id: tsig.id})
+		}, "refused: REFUSED"},
+		{"unsigned", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 0, false, testTSIG{})
+		}, "unsigned response"},
+		{"forged", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 0, true, testTSIG{time: now, fudge: 300, id: tsig.id, mac: make([]byte, 32)})
+		}, "signature mismatch"},
+		{"signed without the request MAC", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, nil, 0, true, testTSIG{time: now, fudge: 300, id: tsig.id})
+		}, "signature mismatch"},
+		{"old", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 0, true, testTSIG{time: now - 400, fudge: 300, id: tsig.id})
+		}, "fudge"},
+		{"bad key", func(request []byte, tsig testTSIG) []byte {
+			return testResponse(request, tsig.mac, 9, true, testTSIG{time: now, fudge: 300, id: tsig.id, tsigError: 17, mac: []byte{}})
+		}, "NOTAUTH response: TSIG error BADKEY"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		server := serveDNS(t, func(request []byte) ([]byte, bool) {
+			_, tsig, _ := parseTSIG(request)
+			return tt.response(request, tsig), false
+		})
+		err := newTestRFC2136(server).Present(context.Background(), "_acme-challenge.example.com", "v")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRFC2136OutOfZone(t *testing.T) {
+	if err := newTestRFC2136("127.0.0.1:1").Present(context.Background(), "_acme-challenge.example.org.", "v"); err == nil {
+		t.Error("updated a name out of the zone")
+	}
+}